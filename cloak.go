@@ -0,0 +1,156 @@
+// Package cloak encrypts folders, files and byte streams into the .cloak
+// format used by the cloak command.
+//
+// NewEncryptingWriter and NewDecryptingReader encrypt an arbitrary stream.
+// EncryptDir and DecryptTo write and read archives of a folder, which the
+// cloak command can also decrypt. None of them print anything or read from
+// the terminal: passwords, keyfiles and X25519 keys are passed in
+// KeyOptions, and progress is reported to an optional ProgressFunc.
+//
+// Files are encrypted with AES-256-GCM in authenticated chunks. The data key
+// is wrapped with a key derived from the password and keyfile with
+// Argon2id, and for each recipient with X25519.
+package cloak
+
+import (
+	"io"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+)
+
+type (
+	// KeyOptions holds the password, keyfile, recipients and identities
+	// that protect a file.
+	KeyOptions = cloak.KeyOptions
+
+	// EncryptDirOptions configures EncryptDir.
+	EncryptDirOptions = cloak.EncryptDirOptions
+
+	// DecryptToOptions configures DecryptTo.
+	DecryptToOptions = cloak.DecryptToOptions
+
+	// Recipient is an X25519 public key that a file can be encrypted to.
+	Recipient = cloak.Recipient
+
+	// Identity is an X25519 secret key that decrypts files encrypted to its
+	// recipient.
+	Identity = cloak.Identity
+
+	// KDFParams are the Argon2id parameters of a password.
+	KDFParams = cloak.KDFParams
+
+	// Compression selects the compressor of an archive.
+	Compression = cloak.Compression
+
+	// ConflictPolicy decides what DecryptTo does with an entry whose path
+	// already exists.
+	ConflictPolicy = cloak.ConflictPolicy
+
+	// ProgressFunc receives the progress events of EncryptDir and
+	// DecryptTo.
+	ProgressFunc = cloak.ProgressFunc
+
+	// ProgressEvent describes how far an operation has come: its phase,
+	// the bytes done out of the total and the current file.
+	ProgressEvent = cloak.ProgressEvent
+
+	// Phase is a step of an operation reported in a ProgressEvent.
+	Phase = cloak.Phase
+)
+
+// Compressors of an archive.
+const (
+	CompressionGzip = cloak.CompressionGzip
+	CompressionNone = cloak.CompressionNone
+	CompressionZstd = cloak.CompressionZstd
+)
+
+// Conflict policies of DecryptTo.
+const (
+	ConflictFail      = cloak.ConflictFail
+	ConflictSkip      = cloak.ConflictSkip
+	ConflictOverwrite = cloak.ConflictOverwrite
+	ConflictRename    = cloak.ConflictRename
+	ConflictNewer     = cloak.ConflictNewer
+)
+
+// Phases reported in a ProgressEvent.
+const (
+	PhaseDeriveKey = cloak.PhaseDeriveKey
+	PhaseEncrypt   = cloak.PhaseEncrypt
+	PhaseDecrypt   = cloak.PhaseDecrypt
+)
+
+// Errors reported when a file cannot be decrypted. Use errors.Is to check
+// for them.
+var (
+	// ErrWrongPassword means that no key slot opens with the given
+	// password, keyfile or identities.
+	ErrWrongPassword = cloak.ErrWrongPassword
+
+	// ErrCorrupted means that the file is malformed or failed
+	// authentication.
+	ErrCorrupted = cloak.ErrCorrupted
+
+	// ErrTruncated means that the file ends before its last chunk.
+	ErrTruncated = cloak.ErrTruncated
+
+	// ErrUnsupportedVersion means that the file uses a format version
+	// that this package cannot read, such as CLOAK01.
+	ErrUnsupportedVersion = cloak.ErrUnsupportedVersion
+
+	// ErrNotCloakFile means that the data is not in any .cloak format.
+	ErrNotCloakFile = cloak.ErrNotCloakFile
+)
+
+// DefaultKDFParams are the Argon2id parameters used when none are given.
+var DefaultKDFParams = cloak.DefaultKDFParams
+
+// NewEncryptingWriter returns a writer that encrypts the bytes written to it
+// into dst. The result can only be read back with NewDecryptingReader.
+// Close must be called to write the final chunk; it does not close dst.
+func NewEncryptingWriter(dst io.Writer, key KeyOptions) (io.WriteCloser, error) {
+	return cloak.NewEncryptingWriter(dst, key)
+}
+
+// NewDecryptingReader returns a reader of the bytes encrypted into src by
+// NewEncryptingWriter. Data is only returned once it has been
+// authenticated. Close must be called when done; it does not close src.
+func NewDecryptingReader(src io.Reader, key KeyOptions) (io.ReadCloser, error) {
+	return cloak.NewDecryptingReader(src, key)
+}
+
+// EncryptDir archives the folder, or regular file, at src and encrypts it
+// into dst as a .cloak file. It does not close dst.
+func EncryptDir(src string, dst io.Writer, opts EncryptDirOptions) error {
+	return cloak.EncryptDir(src, dst, opts)
+}
+
+// DecryptTo decrypts a .cloak file read from src and extracts its archive
+// into destDir, which is created if needed.
+func DecryptTo(src io.Reader, destDir string, opts DecryptToOptions) error {
+	return cloak.DecryptTo(src, destDir, opts)
+}
+
+// GenerateIdentity creates a new random X25519 identity.
+func GenerateIdentity() (*Identity, error) {
+	return cloak.GenerateIdentity()
+}
+
+// ParseRecipient parses a public key in the form printed by the keygen
+// command.
+func ParseRecipient(s string) (*Recipient, error) {
+	return cloak.ParseRecipient(s)
+}
+
+// ParseIdentity parses a secret key in the form written by the keygen
+// command.
+func ParseIdentity(s string) (*Identity, error) {
+	return cloak.ParseIdentity(s)
+}
+
+// LoadIdentities reads the identities in an identity file. Blank lines and
+// lines starting with # are ignored.
+func LoadIdentities(path string) ([]*Identity, error) {
+	return cloak.LoadIdentities(path)
+}
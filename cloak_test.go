@@ -0,0 +1,139 @@
+package cloak_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vsamidurai/cloak"
+)
+
+// fastKDF keeps key derivation quick in tests.
+var fastKDF = cloak.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+// captureStdout runs fn and returns what it printed to standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestEncryptingWriterRoundTrip(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("stream data "), 200000)
+	key := cloak.KeyOptions{Password: []byte("password"), KDF: fastKDF}
+
+	var encrypted bytes.Buffer
+	var decrypted []byte
+	out := captureStdout(t, func() {
+		w, err := cloak.NewEncryptingWriter(&encrypted, key)
+		if err != nil {
+			t.Fatalf("NewEncryptingWriter failed: %v", err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		r, err := cloak.NewDecryptingReader(bytes.NewReader(encrypted.Bytes()), key)
+		if err != nil {
+			t.Fatalf("NewDecryptingReader failed: %v", err)
+		}
+		defer r.Close()
+		if decrypted, err = io.ReadAll(r); err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+	})
+
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("Decrypted stream does not match")
+	}
+	if out != "" {
+		t.Errorf("Nothing should be printed, got %q", out)
+	}
+
+	wrong, err := cloak.NewDecryptingReader(bytes.NewReader(encrypted.Bytes()), cloak.KeyOptions{Password: []byte("wrong")})
+	if !errors.Is(err, cloak.ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+	if wrong != nil {
+		t.Error("A failed NewDecryptingReader should return a nil reader")
+	}
+
+	truncated := encrypted.Bytes()[:encrypted.Len()-100]
+	r, err := cloak.NewDecryptingReader(bytes.NewReader(truncated), key)
+	if err != nil {
+		t.Fatalf("NewDecryptingReader failed: %v", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Expected an error for a truncated stream")
+	}
+}
+
+func TestEncryptDirDecryptTo(t *testing.T) {
+	identity, err := cloak.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	srcDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "sub", "file.txt"), []byte("library"), 0644)
+
+	var encrypted bytes.Buffer
+	destDir := t.TempDir()
+	var files []string
+	out := captureStdout(t, func() {
+		err := cloak.EncryptDir(srcDir, &encrypted, cloak.EncryptDirOptions{
+			Key:         cloak.KeyOptions{Recipients: []*cloak.Recipient{identity.Recipient()}},
+			Compression: cloak.CompressionZstd,
+			Progress: func(e cloak.ProgressEvent) {
+				if e.Phase == cloak.PhaseEncrypt && e.File != "" {
+					files = append(files, e.File)
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("EncryptDir failed: %v", err)
+		}
+
+		err = cloak.DecryptTo(bytes.NewReader(encrypted.Bytes()), destDir, cloak.DecryptToOptions{
+			Key: cloak.KeyOptions{Identities: []*cloak.Identity{identity}},
+		})
+		if err != nil {
+			t.Fatalf("DecryptTo failed: %v", err)
+		}
+	})
+	if out != "" {
+		t.Errorf("Nothing should be printed, got %q", out)
+	}
+	if len(files) == 0 || files[len(files)-1] != "data/sub/file.txt" {
+		t.Errorf("Progress did not report the archived files: %q", files)
+	}
+
+	data, err := os.ReadFile(filepath.Join(destDir, "data", "sub", "file.txt"))
+	if err != nil || string(data) != "library" {
+		t.Errorf("Extracted file: %q, %v", data, err)
+	}
+
+	// A password is never prompted for.
+	err = cloak.DecryptTo(bytes.NewReader(encrypted.Bytes()), t.TempDir(), cloak.DecryptToOptions{})
+	if err == nil {
+		t.Error("Expected an error without credentials")
+	}
+}
@@ -2,10 +2,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
-	"github.com/vsamidurai/cloak/internal/cloak"
 	"github.com/vsamidurai/cloak/internal/cli"
 )
 
@@ -25,25 +25,27 @@ func main() {
 		printUsage()
 		return
 	case "encrypt":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: encrypt requires a folder path")
-			fmt.Fprintln(os.Stderr, "Usage: cloak encrypt <folder_path>")
-			os.Exit(1)
-		}
-		if err := cloak.Encrypt(os.Args[2]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
+		exit(cli.RunEncrypt(os.Args[2:]))
 	case "decrypt":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: decrypt requires a file path")
-			fmt.Fprintln(os.Stderr, "Usage: cloak decrypt <file_path>")
-			os.Exit(1)
-		}
-		if err := cloak.Decrypt(os.Args[2]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
+		exit(cli.RunDecrypt(os.Args[2:]))
+	case "restore":
+		exit(cli.RunRestore(os.Args[2:]))
+	case "list":
+		exit(cli.RunList(os.Args[2:]))
+	case "verify":
+		exit(cli.RunVerify(os.Args[2:]))
+	case "info":
+		exit(cli.RunInfo(os.Args[2:]))
+	case "key":
+		exit(cli.RunKey(os.Args[2:]))
+	case "passwd":
+		exit(cli.RunPasswd(os.Args[2:]))
+	case "keygen":
+		exit(cli.RunKeygen(os.Args[2:]))
+	case "kdf":
+		exit(cli.RunKDF(os.Args[2:]))
+	case "repo":
+		exit(cli.RunRepo(os.Args[2:]))
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
 		printUsage()
@@ -51,19 +53,104 @@ func main() {
 	}
 }
 
+// exit reports err and terminates with the exit status for it if it is set.
+func exit(err error) {
+	code := cli.ExitCode(err)
+	if code == cli.ExitOK {
+		return
+	}
+	if !errors.Is(err, cli.ErrUsage) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	os.Exit(code)
+}
+
 func printUsage() {
 	fmt.Println("Cloak - Secure Directory Encryption Tool")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  cloak encrypt <folder_path>  Encrypt a folder into a .cloak file")
-	fmt.Println("  cloak decrypt <file_path>    Decrypt a .cloak file back to folder")
-	fmt.Println("  cloak -i, --interactive      Start interactive mode with autocomplete")
+	fmt.Println("  cloak encrypt [options] <path>...      Encrypt folders or files into a .cloak file")
+	fmt.Println("  cloak decrypt [options] <file_path> [pattern...]")
+	fmt.Println("                                         Decrypt a .cloak file back to a folder or file, or only")
+	fmt.Println("                                         the entries matching the patterns")
+	fmt.Println("  cloak restore [options] <base.cloak> [increment.cloak...]")
+	fmt.Println("                                         Restore a full .cloak file and the increments made")
+	fmt.Println("                                         after it with --since")
+	fmt.Println("  cloak list [--long] <file_path>        List the contents of a .cloak file without extracting")
+	fmt.Println("  cloak verify [options] <file_path>     Check that a .cloak file decrypts, without extracting")
+	fmt.Println("  cloak info [--json] <file_path>        Show the format, cipher and key slots without a password")
+	fmt.Println("  cloak key list <file_path>             List the key slots of a .cloak file")
+	fmt.Println("  cloak key add [options] <file_path>    Add a password, keyfile or recipient to a .cloak file")
+	fmt.Println("  cloak key remove <file_path> <slot>    Remove a key slot from a .cloak file")
+	fmt.Println("  cloak passwd [options] <file_path>     Change the password of a .cloak file")
+	fmt.Println("  cloak keygen [-o file]                 Generate an X25519 identity for --recipient")
+	fmt.Println("  cloak kdf calibrate [options]          Find Argon2id costs that take --target on this machine")
+	fmt.Println("  cloak repo init [options] <repo>       Create a deduplicating backup repository")
+	fmt.Println("  cloak repo backup <repo> <path>...     Store folders and files as a new snapshot")
+	fmt.Println("  cloak repo restore <repo> <snapshot>   Restore a snapshot, or \"latest\"")
+	fmt.Println("  cloak repo snapshots <repo>            List the snapshots of a repository")
+	fmt.Println("  cloak repo prune [options] <repo> [snapshot...]")
+	fmt.Println("                                         Remove snapshots and the chunks no longer used")
+	fmt.Println("  cloak -i, --interactive                Start interactive mode with autocomplete")
 	fmt.Println()
 	fmt.Println("Options:")
-	fmt.Println("  -h, --help                   Show this help message")
+	fmt.Println("  -h, --help                             Show this help message")
+	fmt.Println("  -o, --output PATH                      Write the encrypted file to PATH, or into directory PATH")
+	fmt.Println("  --exclude PATTERN                      Leave out paths matching PATTERN, in gitignore syntax")
+	fmt.Println("                                         (repeatable); .cloakignore files are always applied")
+	fmt.Println("  --include PATTERN                      Archive matching paths even if excluded (repeatable)")
+	fmt.Println("  --gitignore                            Also leave out the paths listed in .gitignore files")
+	fmt.Println("  --compression CODEC                    Compress with gzip (default), zstd or none")
+	fmt.Println("  --level N                              Compression level: 1-9 for gzip, 1-22 for zstd")
+	fmt.Println("  --since FILE                           Store only what changed since the .cloak file FILE")
+	fmt.Println("  -C, --directory DIR                    Extract into DIR instead of next to the .cloak file")
+	fmt.Println("  --on-conflict POLICY                   What decrypt does with files that already exist:")
+	fmt.Println("                                         fail (default), skip, overwrite, rename, newer")
+	fmt.Println("  --jobs N                               Number of chunks to encrypt/decrypt in parallel")
+	fmt.Println("                                         (default: number of CPUs)")
+	fmt.Println("  --password-file FILE                   Read the password from a file")
+	fmt.Println("  --password-fd N                        Read the password from a file descriptor")
+	fmt.Println("  --password-command CMD                 Read the password from a command's output")
+	fmt.Println("  --keyfile FILE                         Require a keyfile in addition to the password")
+	fmt.Println("  --no-password                          Encrypt with the keyfile or recipients only")
+	fmt.Println("  --recipient KEY                        Also encrypt to a public key (repeatable)")
+	fmt.Println("  --identity FILE                        Decrypt with the secret key in FILE (repeatable)")
+	fmt.Println("  --kdf-profile NAME                     Argon2id cost: interactive (default), moderate, paranoid")
+	fmt.Println("  --kdf-time N                           Argon2id iterations (overrides the profile)")
+	fmt.Println("  --kdf-memory SIZE                      Argon2id memory, e.g. 256MiB (overrides the profile)")
+	fmt.Println("  --kdf-threads N                        Argon2id parallelism (overrides the profile)")
+	fmt.Println()
+	fmt.Println("Environment:")
+	fmt.Println("  CLOAK_PASSWORD                         Password to use when no password option is given")
+	fmt.Println()
+	fmt.Println("Exit status:")
+	fmt.Println("  0                                      Success")
+	fmt.Println("  1                                      Invalid usage or any other error")
+	fmt.Println("  2                                      Wrong password, keyfile or identity")
+	fmt.Println("  3                                      The file is corrupted or has been modified")
+	fmt.Println("  4                                      The file is truncated")
+	fmt.Println("  5                                      The file uses an unsupported format version")
+	fmt.Println("  6                                      The file is not a .cloak file")
 	fmt.Println()
 	fmt.Println("Examples:")
-	fmt.Println("  cloak encrypt ./my_folder    Creates my_folder.cloak")
+	fmt.Println("  cloak encrypt ./my_folder              Creates my_folder.cloak")
 	fmt.Println("  cloak decrypt ./my_folder.cloak")
-	fmt.Println("  cloak -i                     Enter interactive mode")
+	fmt.Println("  cloak encrypt ./db.sql                 Creates db.sql.cloak")
+	fmt.Println("  cloak encrypt -o /mnt/backup ./my_folder")
+	fmt.Println("  cloak encrypt -o bundle.cloak dirA dirB notes.txt")
+	fmt.Println("  cloak encrypt --exclude node_modules --gitignore ./my_project")
+	fmt.Println("  cloak encrypt --compression zstd ./my_folder")
+	fmt.Println("  cloak encrypt --since full.cloak -o mon.cloak ./my_folder")
+	fmt.Println("  cloak restore -C /tmp/restore full.cloak mon.cloak tue.cloak")
+	fmt.Println("  cloak decrypt -C /tmp/restore /mnt/backup/my_folder.cloak")
+	fmt.Println("  cloak decrypt ./my_folder.cloak 'my_folder/docs/**/*.md'")
+	fmt.Println("  cloak encrypt --jobs 4 ./my_folder     Encrypt using 4 workers")
+	fmt.Println("  cloak verify ./my_folder.cloak         Check a backup before relying on it")
+	fmt.Println("  cloak key add ./my_folder.cloak        Add a second password")
+	fmt.Println("  cloak passwd ./my_folder.cloak         Change the password")
+	fmt.Println("  cloak keygen -o key.txt                Create an identity; share its public key")
+	fmt.Println("  cloak kdf calibrate --target 1s --max-memory 512MB")
+	fmt.Println("  cloak repo backup /mnt/repo ./my_folder")
+	fmt.Println("  cloak repo prune --keep-last 7 /mnt/repo")
+	fmt.Println("  cloak -i                               Enter interactive mode")
 }
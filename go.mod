@@ -4,6 +4,7 @@ go 1.25.1
 
 require (
 	github.com/c-bata/go-prompt v0.2.6
+	github.com/klauspost/compress v1.20.1
 	golang.org/x/crypto v0.47.0
 	golang.org/x/term v0.39.0
 )
@@ -0,0 +1,1258 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+	"github.com/vsamidurai/cloak/internal/repo"
+)
+
+// ErrUsage is returned when a command is called with invalid arguments.
+// The error and the command usage have already been printed.
+var ErrUsage = errors.New("invalid usage")
+
+// usageOutput receives usage messages and flag errors.
+var usageOutput io.Writer = os.Stderr
+
+// newFlagSet creates a flag set for a command with the given usage line.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(usageOutput)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cloak %s\n", usage)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(fs.Output(), "Options:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, ErrUsage
+		}
+
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// usageError prints msg followed by the command usage and returns ErrUsage.
+func usageError(fs *flag.FlagSet, msg string) error {
+	fmt.Fprintf(fs.Output(), "Error: %s\n", msg)
+	fs.Usage()
+	return ErrUsage
+}
+
+// Exit statuses of the cloak command. Scripts can rely on them to tell a
+// wrong password apart from a damaged file.
+const (
+	ExitOK                 = 0
+	ExitError              = 1
+	ExitBadPassword        = 2
+	ExitCorrupted          = 3
+	ExitTruncated          = 4
+	ExitUnsupportedVersion = 5
+	ExitNotCloakFile       = 6
+)
+
+// ExitCode returns the exit status for the error returned by a command.
+func ExitCode(err error) int {
+	switch {
+	case err == nil || errors.Is(err, flag.ErrHelp):
+		return ExitOK
+	case errors.Is(err, cloak.ErrNotCloakFile):
+		return ExitNotCloakFile
+	case errors.Is(err, cloak.ErrUnsupportedVersion):
+		return ExitUnsupportedVersion
+	case errors.Is(err, cloak.ErrWrongPassword):
+		return ExitBadPassword
+	case errors.Is(err, cloak.ErrTruncated):
+		return ExitTruncated
+	case errors.Is(err, cloak.ErrCorrupted):
+		return ExitCorrupted
+	default:
+		return ExitError
+	}
+}
+
+// addJobsFlag registers the --jobs option on fs.
+func addJobsFlag(fs *flag.FlagSet) *int {
+	return fs.Int("jobs", cloak.DefaultJobs(), "number of chunks to process in parallel")
+}
+
+// stringList is a flag value that collects every occurrence of a
+// repeatable option.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseRecipients parses --recipient values. Each value is a public key or
+// the path of a file listing one public key per line.
+func parseRecipients(values []string) ([]*cloak.Recipient, error) {
+	var recipients []*cloak.Recipient
+	for _, value := range values {
+		if strings.HasPrefix(value, cloak.RecipientPrefix) {
+			r, err := cloak.ParseRecipient(value)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recipients file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			r, err := cloak.ParseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", value, err)
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients, nil
+}
+
+// loadIdentities loads the identities of every --identity file.
+func loadIdentities(paths []string) ([]*cloak.Identity, error) {
+	var identities []*cloak.Identity
+	for _, path := range paths {
+		ids, err := cloak.LoadIdentities(path)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, ids...)
+	}
+	return identities, nil
+}
+
+// kdfFlags holds the key derivation options of a command.
+type kdfFlags struct {
+	profile string
+	time    uint
+	memory  string
+	threads uint
+}
+
+// addKDFFlags registers the key derivation options on fs.
+func addKDFFlags(fs *flag.FlagSet) *kdfFlags {
+	k := &kdfFlags{}
+	fs.StringVar(&k.profile, "kdf-profile", "interactive", "Argon2id cost `profile`: interactive, moderate or paranoid")
+	fs.UintVar(&k.time, "kdf-time", 0, "Argon2id iterations `N` (overrides the profile)")
+	fs.StringVar(&k.memory, "kdf-memory", "", "Argon2id memory `size` such as 256MiB (overrides the profile)")
+	fs.UintVar(&k.threads, "kdf-threads", 0, "Argon2id parallelism `N` (overrides the profile)")
+	return k
+}
+
+// given reports whether any key derivation option was set on the command line.
+func (k *kdfFlags) given(fs *flag.FlagSet) bool {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "kdf-") {
+			given = true
+		}
+	})
+	return given
+}
+
+// params returns the KDF parameters selected by the options: the profile,
+// with any cost given explicitly replacing the profile's value.
+func (k *kdfFlags) params() (cloak.KDFParams, error) {
+	params, err := cloak.KDFProfile(k.profile)
+	if err != nil {
+		return cloak.KDFParams{}, err
+	}
+
+	if k.time != 0 {
+		if k.time > math.MaxUint32 {
+			return cloak.KDFParams{}, errors.New("--kdf-time is too large")
+		}
+		params.Time = uint32(k.time)
+	}
+	if k.memory != "" {
+		size, err := parseSize(k.memory, 1<<20)
+		if err != nil {
+			return cloak.KDFParams{}, fmt.Errorf("invalid --kdf-memory: %w", err)
+		}
+		if size/1024 > math.MaxUint32 {
+			return cloak.KDFParams{}, errors.New("--kdf-memory is too large")
+		}
+		params.Memory = uint32(size / 1024)
+	}
+	if k.threads != 0 {
+		if k.threads > math.MaxUint8 {
+			return cloak.KDFParams{}, fmt.Errorf("--kdf-threads must be at most %d", math.MaxUint8)
+		}
+		params.Threads = uint8(k.threads)
+	}
+
+	if err := params.Validate(); err != nil {
+		return cloak.KDFParams{}, err
+	}
+	return params, nil
+}
+
+// sizeUnits are the suffixes accepted by parseSize. K, M and G are powers of
+// 1024 whether or not the i is written.
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+	{"b", 1},
+}
+
+// parseSize parses a size such as 512MB or 1GiB into bytes. A number without
+// a suffix is a count of unit bytes.
+func parseSize(s string, unit int64) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * unit, nil
+}
+
+// decryptFlags holds the options of commands that decrypt a file.
+type decryptFlags struct {
+	jobs       *int
+	password   *passwordFlags
+	keyfile    *string
+	identities stringList
+}
+
+// addDecryptFlags registers the options that unlock and decrypt a file on fs.
+func addDecryptFlags(fs *flag.FlagSet) *decryptFlags {
+	d := &decryptFlags{}
+	d.jobs = addJobsFlag(fs)
+	d.password = addPasswordFlags(fs)
+	d.keyfile = fs.String("keyfile", "", "read the keyfile from `path` if the file requires one")
+	fs.Var(&d.identities, "identity", "try the secret keys in `file` (repeatable)")
+	return d
+}
+
+// options validates the options and returns them as DecryptOptions.
+func (d *decryptFlags) options(fs *flag.FlagSet) (cloak.DecryptOptions, error) {
+	if *d.jobs < 1 {
+		return cloak.DecryptOptions{}, usageError(fs, "--jobs must be at least 1")
+	}
+
+	identities, err := loadIdentities(d.identities)
+	if err != nil {
+		return cloak.DecryptOptions{}, err
+	}
+
+	password, err := d.password.provider()
+	if err != nil {
+		return cloak.DecryptOptions{}, usageError(fs, err.Error())
+	}
+
+	return cloak.DecryptOptions{
+		Password:   password,
+		Keyfile:    *d.keyfile,
+		Identities: identities,
+		Jobs:       *d.jobs,
+	}, nil
+}
+
+// passwordFlags holds the password source options of a command.
+type passwordFlags struct {
+	prefix  string
+	env     string
+	file    string
+	fd      int
+	command string
+}
+
+// addPasswordFlags registers the password source options on fs.
+func addPasswordFlags(fs *flag.FlagSet) *passwordFlags {
+	return addPrefixedPasswordFlags(fs, "", "the password", cloak.PasswordEnv)
+}
+
+// addNewPasswordFlags registers the options that supply a new password on fs.
+func addNewPasswordFlags(fs *flag.FlagSet) *passwordFlags {
+	return addPrefixedPasswordFlags(fs, "new-", "the new password", "")
+}
+
+// addPrefixedPasswordFlags registers password source options whose names
+// start with prefix. If env is set, the password is read from that
+// environment variable when no option is given.
+func addPrefixedPasswordFlags(fs *flag.FlagSet, prefix, what, env string) *passwordFlags {
+	p := &passwordFlags{prefix: prefix, env: env}
+	fs.StringVar(&p.file, prefix+"password-file", "", "read "+what+" from the first line of `file`")
+	fs.IntVar(&p.fd, prefix+"password-fd", -1, "read "+what+" from file descriptor `N`")
+	fs.StringVar(&p.command, prefix+"password-command", "", "read "+what+" from the output of a shell `command`")
+	return p
+}
+
+// provider returns the password provider selected by the options. Without
+// options the password is read from the environment variable if it is set,
+// and from the terminal otherwise.
+func (p *passwordFlags) provider() (cloak.PasswordProvider, error) {
+	var providers []cloak.PasswordProvider
+	if p.file != "" {
+		providers = append(providers, cloak.FilePassword{Path: p.file})
+	}
+	if p.fd >= 0 {
+		providers = append(providers, cloak.FDPassword{FD: p.fd})
+	}
+	if p.command != "" {
+		providers = append(providers, cloak.CommandPassword{Command: p.command})
+	}
+
+	switch len(providers) {
+	case 0:
+		if _, ok := os.LookupEnv(p.env); ok && p.env != "" {
+			return cloak.EnvPassword{Name: p.env}, nil
+		}
+		return cloak.TerminalPassword{}, nil
+	case 1:
+		return providers[0], nil
+	default:
+		return nil, fmt.Errorf("only one of --%[1]spassword-file, --%[1]spassword-fd and --%[1]spassword-command may be given", p.prefix)
+	}
+}
+
+// RunEncrypt runs the encrypt command with the given arguments.
+func RunEncrypt(args []string) error {
+	fs := newFlagSet("encrypt", "encrypt [options] <path>...")
+	jobs := addJobsFlag(fs)
+	passwordOpts := addPasswordFlags(fs)
+	keyfile := fs.String("keyfile", "", "also require the keyfile at `path` to decrypt")
+	noPassword := fs.Bool("no-password", false, "protect the file with the keyfile or recipients only")
+	var recipientArgs stringList
+	fs.Var(&recipientArgs, "recipient", "also encrypt to the public `key` or the keys listed in a file (repeatable)")
+	kdfOpts := addKDFFlags(fs)
+	var excludes, includes stringList
+	fs.Var(&excludes, "exclude", "leave out paths matching `pattern`, in gitignore syntax (repeatable)")
+	fs.Var(&includes, "include", "archive paths matching `pattern` even if they are excluded (repeatable)")
+	gitIgnore := fs.Bool("gitignore", false, "also leave out the paths listed in .gitignore files")
+	compression := fs.String("compression", "gzip", "compress the archive with `codec`: gzip, zstd or none")
+	level := fs.Int("level", 0, "compression level: 1-9 for gzip, 1-22 for zstd (default: the codec's default)")
+	output := fs.String("output", "", "write the encrypted file to `path`, or into it if it is a directory")
+	fs.StringVar(output, "o", "", "shorthand for --output")
+	since := fs.String("since", "", "store only what changed since the earlier encrypted `file`")
+	var identityArgs stringList
+	fs.Var(&identityArgs, "identity", "unlock the --since file with the secret keys in `file` (repeatable)")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return usageError(fs, "encrypt requires a folder or file path")
+	}
+	if len(identityArgs) > 0 && *since == "" {
+		return usageError(fs, "--identity requires --since")
+	}
+	if len(positional) > 1 && *output == "" {
+		return usageError(fs, "--output is required to encrypt several paths")
+	}
+	if *noPassword && *keyfile == "" && len(recipientArgs) == 0 {
+		return usageError(fs, "--no-password requires --keyfile or --recipient")
+	}
+	if *jobs < 1 {
+		return usageError(fs, "--jobs must be at least 1")
+	}
+
+	kdf, err := kdfOpts.params()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	codec, err := cloak.ParseCompression(*compression)
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+	if err := codec.ValidateLevel(*level); err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	recipients, err := parseRecipients(recipientArgs)
+	if err != nil {
+		return err
+	}
+
+	identities, err := loadIdentities(identityArgs)
+	if err != nil {
+		return err
+	}
+
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	paths := make([]string, len(positional))
+	for i, p := range positional {
+		paths[i] = filepath.Clean(p)
+	}
+	progress := newProgressBar(true)
+	result, err := cloak.EncryptPaths(paths, cloak.EncryptOptions{
+		Password:         password,
+		Keyfile:          *keyfile,
+		NoPassword:       *noPassword,
+		Recipients:       recipients,
+		KDF:              kdf,
+		Exclude:          excludes,
+		Include:          includes,
+		GitIgnore:        *gitIgnore,
+		Compression:      codec,
+		CompressionLevel: *level,
+		Output:           *output,
+		Since:            *since,
+		Identities:       identities,
+		Jobs:             *jobs,
+		Progress:         progress.update,
+	})
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if result.Excluded > 0 {
+		fmt.Printf("Excluded %d paths\n", result.Excluded)
+	}
+	if *since != "" {
+		fmt.Printf("Left out %d unchanged paths, recorded %d deleted paths\n", result.Unchanged, result.Deleted)
+	}
+	fmt.Printf("Successfully encrypted to: %s\n", result.Output)
+	fmt.Printf("Archive size: %d bytes, Encrypted size: %d bytes\n", result.ArchiveSize, result.EncryptedSize)
+	return nil
+}
+
+// RunDecrypt runs the decrypt command with the given arguments.
+func RunDecrypt(args []string) error {
+	fs := newFlagSet("decrypt", "decrypt [options] <file_path> [pattern...]")
+	decryptOpts := addDecryptFlags(fs)
+	directory := fs.String("directory", "", "extract into `dir` instead of the directory of the file")
+	fs.StringVar(directory, "C", "", "shorthand for --directory")
+	onConflict := fs.String("on-conflict", "fail", "`policy` for files that already exist: fail, skip, overwrite, rename or newer")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		return usageError(fs, "decrypt requires a file path")
+	}
+	policy, err := cloak.ParseConflictPolicy(*onConflict)
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	opts, err := decryptOpts.options(fs)
+	if err != nil {
+		return err
+	}
+	opts.Patterns = positional[1:]
+	opts.Directory = *directory
+	opts.OnConflict = policy
+
+	progress := newProgressBar(true)
+	opts.Progress = progress.update
+	result, err := cloak.Decrypt(positional[0], opts)
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if result.Incremental {
+		fmt.Println("Note: this is an incremental archive; use restore to apply it to its base")
+	}
+	if len(opts.Patterns) > 0 {
+		fmt.Printf("Extracted %d matching entries\n", result.Extracted)
+	}
+	if result.Skipped > 0 {
+		fmt.Printf("Skipped %d existing files\n", result.Skipped)
+	}
+	if result.Renamed > 0 {
+		fmt.Printf("Renamed %d files that already existed\n", result.Renamed)
+	}
+	fmt.Printf("Successfully decrypted to: %s\n", result.Directory)
+	return nil
+}
+
+// RunRestore runs the restore command, which extracts a full archive and
+// applies the incremental archives made after it.
+func RunRestore(args []string) error {
+	fs := newFlagSet("restore", "restore [options] <base.cloak> [increment.cloak...]")
+	decryptOpts := addDecryptFlags(fs)
+	directory := fs.String("directory", "", "restore into `dir` instead of the directory of the base file")
+	fs.StringVar(directory, "C", "", "shorthand for --directory")
+	onConflict := fs.String("on-conflict", "fail", "`policy` for files of the base that already exist: fail, skip, overwrite, rename or newer")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		return usageError(fs, "restore requires a base file path")
+	}
+	policy, err := cloak.ParseConflictPolicy(*onConflict)
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	opts, err := decryptOpts.options(fs)
+	if err != nil {
+		return err
+	}
+	opts.Directory = *directory
+	opts.OnConflict = policy
+
+	progress := newProgressBar(true)
+	opts.Progress = progress.update
+	result, err := cloak.Restore(positional, opts)
+	progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if result.Deleted > 0 {
+		fmt.Printf("Removed %d deleted paths\n", result.Deleted)
+	}
+	fmt.Printf("Successfully restored %d archives to: %s\n", result.Archives, result.Directory)
+	return nil
+}
+
+// RunList runs the list command, which prints the contents of a file
+// without extracting it.
+func RunList(args []string) error {
+	fs := newFlagSet("list", "list [options] <file_path>")
+	decryptOpts := addDecryptFlags(fs)
+	long := fs.Bool("long", false, "show the mode, size, modification time and link target of each entry")
+	fs.BoolVar(long, "l", false, "shorthand for --long")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "list requires a file path")
+	}
+
+	opts, err := decryptOpts.options(fs)
+	if err != nil {
+		return err
+	}
+	// Entries are printed while the file is decrypted, so no bar is drawn.
+	opts.Progress = newProgressBar(false).update
+
+	return cloak.List(positional[0], opts, func(e cloak.Entry) error {
+		if !*long {
+			fmt.Println(e.Name)
+			return nil
+		}
+
+		name := e.Name
+		if e.Linkname != "" {
+			name += " -> " + e.Linkname
+		}
+		fmt.Printf("%s %12d %s %s\n", e.Mode, e.Size, e.ModTime.Local().Format("2006-01-02 15:04"), name)
+		return nil
+	})
+}
+
+// RunVerify runs the verify command, which decrypts and authenticates a
+// file without writing anything to disk.
+func RunVerify(args []string) error {
+	fs := newFlagSet("verify", "verify [options] <file_path>")
+	decryptOpts := addDecryptFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "verify requires a file path")
+	}
+
+	opts, err := decryptOpts.options(fs)
+	if err != nil {
+		return err
+	}
+
+	progress := newProgressBar(true)
+	opts.Progress = progress.update
+	result, err := cloak.Verify(positional[0], opts)
+	progress.finish()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK: %s (%d entries, %d bytes)\n", positional[0], result.Entries, result.Size)
+	return nil
+}
+
+// RunInfo runs the info command, which describes the header of a file
+// without asking for a password.
+func RunInfo(args []string) error {
+	fs := newFlagSet("info", "info [--json] <file_path>")
+	asJSON := fs.Bool("json", false, "print the description as JSON")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "info requires a file path")
+	}
+
+	info, err := cloak.Inspect(positional[0])
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	fmt.Printf("File:        %s\n", positional[0])
+	fmt.Printf("Format:      %s (version %d)\n", info.Format, info.Version)
+	fmt.Printf("Cipher:      %s\n", info.Cipher)
+	fmt.Printf("Payload:     %s\n", info.Payload)
+	fmt.Printf("Compression: %s\n", info.Compression)
+	if info.ChunkSize != 0 {
+		fmt.Printf("Chunk size:  %d bytes (%d chunks)\n", info.ChunkSize, info.Chunks)
+	}
+	if info.HeaderAuthenticated {
+		fmt.Printf("Header:      %d bytes, authenticated\n", info.HeaderSize)
+	} else {
+		fmt.Printf("Header:      %d bytes, not authenticated\n", info.HeaderSize)
+	}
+	fmt.Printf("Ciphertext:  %d bytes\n", info.CiphertextSize)
+	fmt.Printf("Key slots:   %d (%d recipients)\n", len(info.Slots), info.Recipients)
+	for i, slot := range info.Slots {
+		switch {
+		case slot.KDF != nil:
+			fmt.Printf("  %d: %s (%s)\n", i, strings.Join(slot.Factors, " + "), slot.KDF)
+		case slot.Type == "x25519":
+			fmt.Printf("  %d: recipient (X25519)\n", i)
+		default:
+			fmt.Printf("  %d: %s\n", i, slot.Type)
+		}
+	}
+	return nil
+}
+
+// RunKey runs the key command, which manages the key slots of a file.
+func RunKey(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(usageOutput, "Error: key requires a subcommand")
+		printKeyUsage()
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "add":
+		return runKeyAdd(args[1:])
+	case "remove":
+		return runKeyRemove(args[1:])
+	case "list":
+		return runKeyList(args[1:])
+	case "-h", "--help", "help":
+		printKeyUsage()
+		return nil
+	default:
+		fmt.Fprintf(usageOutput, "Error: unknown key subcommand: %s\n", args[0])
+		printKeyUsage()
+		return ErrUsage
+	}
+}
+
+// printKeyUsage prints the usage of the key command.
+func printKeyUsage() {
+	fmt.Fprintln(usageOutput, "Usage:")
+	fmt.Fprintln(usageOutput, "  cloak key list <file_path>            List the key slots of a file")
+	fmt.Fprintln(usageOutput, "  cloak key add [options] <file_path>   Add a password, keyfile or recipient to a file")
+	fmt.Fprintln(usageOutput, "  cloak key remove [options] <file_path> <slot>")
+	fmt.Fprintln(usageOutput, "                                        Remove a key slot from a file")
+}
+
+// runKeyAdd runs the key add command.
+func runKeyAdd(args []string) error {
+	fs := newFlagSet("key add", "key add [options] <file_path>")
+	passwordOpts := addPasswordFlags(fs)
+	keyfile := fs.String("keyfile", "", "read the current keyfile from `path` if needed")
+	var identityArgs stringList
+	fs.Var(&identityArgs, "identity", "unlock the file with the secret keys in `file` (repeatable)")
+	newPasswordOpts := addNewPasswordFlags(fs)
+	newKeyfile := fs.String("new-keyfile", "", "also require the keyfile at `path` for the new slot")
+	newNoPassword := fs.Bool("new-no-password", false, "protect the new slot with the keyfile only")
+	newRecipient := fs.String("new-recipient", "", "add a slot for the public `key` instead of a password")
+	kdfOpts := addKDFFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "key add requires a file path")
+	}
+	if *newNoPassword && *newKeyfile == "" {
+		return usageError(fs, "--new-no-password requires --new-keyfile")
+	}
+	if *newRecipient != "" && (*newNoPassword || *newKeyfile != "") {
+		return usageError(fs, "--new-recipient cannot be combined with --new-keyfile or --new-no-password")
+	}
+
+	kdf, err := kdfOpts.params()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	var recipient *cloak.Recipient
+	if *newRecipient != "" {
+		recipient, err = cloak.ParseRecipient(*newRecipient)
+		if err != nil {
+			return err
+		}
+	}
+
+	identities, err := loadIdentities(identityArgs)
+	if err != nil {
+		return err
+	}
+
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+	newPassword, err := newPasswordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	index, err := cloak.AddKeySlot(positional[0], cloak.KeyAddOptions{
+		Password:      password,
+		Keyfile:       *keyfile,
+		Identities:    identities,
+		NewRecipient:  recipient,
+		NewPassword:   newPassword,
+		NewKeyfile:    *newKeyfile,
+		NewNoPassword: *newNoPassword,
+		NewKDF:        kdf,
+		Progress:      newProgressBar(false).update,
+	})
+	if err != nil {
+		return err
+	}
+
+	slots, err := cloak.ListKeySlots(positional[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added key slot %d (%s)\n", index, slots[index].Description())
+	return nil
+}
+
+// runKeyRemove runs the key remove command.
+func runKeyRemove(args []string) error {
+	fs := newFlagSet("key remove", "key remove [options] <file_path> <slot>")
+	passwordOpts := addPasswordFlags(fs)
+	keyfile := fs.String("keyfile", "", "read the keyfile from `path` if needed")
+	var identityArgs stringList
+	fs.Var(&identityArgs, "identity", "unlock the file with the secret keys in `file` (repeatable)")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs, "key remove requires a file path and a slot number")
+	}
+
+	slot, err := strconv.Atoi(positional[1])
+	if err != nil {
+		return usageError(fs, fmt.Sprintf("invalid slot number: %s", positional[1]))
+	}
+
+	identities, err := loadIdentities(identityArgs)
+	if err != nil {
+		return err
+	}
+
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	err = cloak.RemoveKeySlot(positional[0], slot, cloak.KeyRemoveOptions{
+		Password:   password,
+		Keyfile:    *keyfile,
+		Identities: identities,
+		Progress:   newProgressBar(false).update,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed key slot %d\n", slot)
+	return nil
+}
+
+// runKeyList runs the key list command.
+func runKeyList(args []string) error {
+	fs := newFlagSet("key list", "key list <file_path>")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "key list requires a file path")
+	}
+
+	slots, err := cloak.ListKeySlots(positional[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key slots in %s (%d of %d used):\n", positional[0], len(slots), cloak.MaxKeySlots)
+	for i, slot := range slots {
+		fmt.Printf("  %d: %s\n", i, slot.Description())
+	}
+	return nil
+}
+
+// RunKeygen runs the keygen command, which creates an X25519 identity.
+func RunKeygen(args []string) error {
+	fs := newFlagSet("keygen", "keygen [options]")
+	output := fs.String("o", "", "write the identity to `file` instead of standard output")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs, "keygen takes no arguments")
+	}
+
+	identity, err := cloak.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	text, err := identity.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err := os.Stdout.Write(text)
+		return err
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create identity file: %w", err)
+	}
+	if _, err := file.Write(text); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(*output)
+		return fmt.Errorf("failed to write identity file: %w", err)
+	}
+
+	fmt.Printf("Public key: %s\n", identity.Recipient())
+	return nil
+}
+
+// RunPasswd runs the passwd command, which changes the password of a file
+// without re-encrypting it.
+func RunPasswd(args []string) error {
+	fs := newFlagSet("passwd", "passwd [options] <file_path>")
+	passwordOpts := addPasswordFlags(fs)
+	keyfile := fs.String("keyfile", "", "read the keyfile from `path` if the password slot requires one")
+	newPasswordOpts := addNewPasswordFlags(fs)
+	kdfOpts := addKDFFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "passwd requires a file path")
+	}
+
+	// Without KDF options the slot keeps its current parameters.
+	var kdf cloak.KDFParams
+	if kdfOpts.given(fs) {
+		kdf, err = kdfOpts.params()
+		if err != nil {
+			return usageError(fs, err.Error())
+		}
+	}
+
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+	newPassword, err := newPasswordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	index, err := cloak.ChangePassword(positional[0], cloak.PasswdOptions{
+		Password:    password,
+		Keyfile:     *keyfile,
+		NewPassword: newPassword,
+		NewKDF:      kdf,
+		Progress:    newProgressBar(false).update,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Changed the password of key slot %d\n", index)
+	return nil
+}
+
+// RunKDF runs the kdf command, which helps choose key derivation costs.
+func RunKDF(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(usageOutput, "Error: kdf requires a subcommand")
+		printKDFUsage()
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "calibrate":
+		return runKDFCalibrate(args[1:])
+	case "-h", "--help", "help":
+		printKDFUsage()
+		return nil
+	default:
+		fmt.Fprintf(usageOutput, "Error: unknown kdf subcommand: %s\n", args[0])
+		printKDFUsage()
+		return ErrUsage
+	}
+}
+
+// printKDFUsage prints the usage of the kdf command.
+func printKDFUsage() {
+	fmt.Fprintln(usageOutput, "Usage:")
+	fmt.Fprintln(usageOutput, "  cloak kdf calibrate [options]   Find Argon2id costs for this machine")
+}
+
+// runKDFCalibrate runs the kdf calibrate command.
+func runKDFCalibrate(args []string) error {
+	fs := newFlagSet("kdf calibrate", "kdf calibrate [options]")
+	target := fs.Duration("target", time.Second, "how long one key derivation should take")
+	maxMemory := fs.String("max-memory", "256MiB", "largest memory `size` to use, such as 512MB")
+	threads := fs.Uint("threads", uint(cloak.DefaultKDFParams.Threads), "Argon2id parallelism `N`")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError(fs, "kdf calibrate takes no arguments")
+	}
+	if *target <= 0 {
+		return usageError(fs, "--target must be positive")
+	}
+	if *threads < 1 || *threads > math.MaxUint8 {
+		return usageError(fs, fmt.Sprintf("--threads must be between 1 and %d", math.MaxUint8))
+	}
+
+	size, err := parseSize(*maxMemory, 1<<20)
+	if err != nil {
+		return usageError(fs, fmt.Sprintf("invalid --max-memory: %v", err))
+	}
+	if size/1024 > cloak.MaxKDFMemory {
+		size = cloak.MaxKDFMemory * 1024
+	}
+
+	fmt.Printf("Calibrating Argon2id for %s per key derivation (this may take a while)...\n", *target)
+
+	params, elapsed, err := cloak.CalibrateKDF(cloak.CalibrateOptions{
+		Target:    *target,
+		MaxMemory: uint32(size / 1024),
+		Threads:   uint8(*threads),
+		Progress: func(p cloak.KDFParams, d time.Duration) {
+			fmt.Printf("  %-32s %s\n", p, d.Round(time.Millisecond))
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if elapsed > *target {
+		fmt.Println()
+		fmt.Println("Warning: even the smallest memory cost tried exceeds the target time.")
+	}
+
+	fmt.Println()
+	fmt.Printf("Calibrated parameters: %s (%s)\n", params, elapsed.Round(time.Millisecond))
+	fmt.Println()
+	fmt.Println("Use them with:")
+	fmt.Printf("  cloak encrypt --kdf-time %d --kdf-memory %s --kdf-threads %d <path>\n",
+		params.Time, cloak.FormatKiB(params.Memory), params.Threads)
+	return nil
+}
+
+// RunRepo runs the repo command and its subcommands.
+func RunRepo(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(usageOutput, "Error: repo requires a subcommand")
+		printRepoUsage()
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "init":
+		return runRepoInit(args[1:])
+	case "backup":
+		return runRepoBackup(args[1:])
+	case "restore":
+		return runRepoRestore(args[1:])
+	case "snapshots":
+		return runRepoSnapshots(args[1:])
+	case "prune":
+		return runRepoPrune(args[1:])
+	case "-h", "--help", "help":
+		printRepoUsage()
+		return nil
+	default:
+		fmt.Fprintf(usageOutput, "Error: unknown repo subcommand: %s\n", args[0])
+		printRepoUsage()
+		return ErrUsage
+	}
+}
+
+// printRepoUsage prints the usage of the repo command.
+func printRepoUsage() {
+	fmt.Fprintln(usageOutput, "Usage:")
+	fmt.Fprintln(usageOutput, "  cloak repo init [options] <repo>      Create an empty repository")
+	fmt.Fprintln(usageOutput, "  cloak repo backup [options] <repo> <path>...")
+	fmt.Fprintln(usageOutput, "                                        Store folders and files as a new snapshot")
+	fmt.Fprintln(usageOutput, "  cloak repo restore [options] <repo> <snapshot>")
+	fmt.Fprintln(usageOutput, "                                        Restore a snapshot, or \"latest\"")
+	fmt.Fprintln(usageOutput, "  cloak repo snapshots [options] <repo> List the snapshots of a repository")
+	fmt.Fprintln(usageOutput, "  cloak repo prune [options] <repo> [snapshot...]")
+	fmt.Fprintln(usageOutput, "                                        Remove snapshots and unused chunks")
+}
+
+// openRepo opens the repository at path with the password options.
+func openRepo(fs *flag.FlagSet, passwordOpts *passwordFlags, path string) (*repo.Repository, error) {
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return nil, usageError(fs, err.Error())
+	}
+	return repo.Open(path, password)
+}
+
+// runRepoInit runs the repo init command.
+func runRepoInit(args []string) error {
+	fs := newFlagSet("repo init", "repo init [options] <repo>")
+	passwordOpts := addPasswordFlags(fs)
+	kdfOpts := addKDFFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "repo init requires a repository path")
+	}
+
+	kdf, err := kdfOpts.params()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+	password, err := passwordOpts.provider()
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+
+	if err := repo.Init(positional[0], repo.InitOptions{Password: password, KDF: kdf}); err != nil {
+		return err
+	}
+	fmt.Printf("Created repository at %s\n", positional[0])
+	return nil
+}
+
+// runRepoBackup runs the repo backup command.
+func runRepoBackup(args []string) error {
+	fs := newFlagSet("repo backup", "repo backup [options] <repo> <path>...")
+	passwordOpts := addPasswordFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 2 {
+		return usageError(fs, "repo backup requires a repository path and a folder or file path")
+	}
+
+	r, err := openRepo(fs, passwordOpts, positional[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	paths := make([]string, len(positional)-1)
+	for i, p := range positional[1:] {
+		paths[i] = filepath.Clean(p)
+	}
+	result, err := r.Backup(paths)
+	if err != nil {
+		return err
+	}
+
+	s := result.Snapshot
+	fmt.Printf("Snapshot %s saved: %d files, %d bytes\n", s.ShortID(), s.Files, s.Size)
+	fmt.Printf("Stored %d new of %d chunks, %d bytes added\n", result.NewChunks, result.Chunks, result.Added)
+	return nil
+}
+
+// runRepoRestore runs the repo restore command.
+func runRepoRestore(args []string) error {
+	fs := newFlagSet("repo restore", "repo restore [options] <repo> <snapshot>")
+	passwordOpts := addPasswordFlags(fs)
+	directory := fs.String("directory", ".", "restore into `dir`")
+	fs.StringVar(directory, "C", ".", "shorthand for --directory")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageError(fs, "repo restore requires a repository path and a snapshot id")
+	}
+
+	r, err := openRepo(fs, passwordOpts, positional[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	s, err := r.FindSnapshot(positional[1])
+	if err != nil {
+		return err
+	}
+	if err := r.Restore(s, *directory); err != nil {
+		return err
+	}
+	fmt.Printf("Restored snapshot %s to: %s\n", s.ShortID(), *directory)
+	return nil
+}
+
+// runRepoSnapshots runs the repo snapshots command.
+func runRepoSnapshots(args []string) error {
+	fs := newFlagSet("repo snapshots", "repo snapshots [options] <repo>")
+	passwordOpts := addPasswordFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError(fs, "repo snapshots requires a repository path")
+	}
+
+	r, err := openRepo(fs, passwordOpts, positional[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		fmt.Printf("%s  %s  %-12s %6d files %12d bytes  %s\n", s.ShortID(),
+			s.Time.Local().Format("2006-01-02 15:04:05"), s.Hostname, s.Files, s.Size, strings.Join(s.Paths, " "))
+	}
+	fmt.Printf("%d snapshots\n", len(snapshots))
+	return nil
+}
+
+// runRepoPrune runs the repo prune command.
+func runRepoPrune(args []string) error {
+	fs := newFlagSet("repo prune", "repo prune [options] <repo> [snapshot...]")
+	passwordOpts := addPasswordFlags(fs)
+	keepLast := fs.Int("keep-last", 0, "remove all but the newest `N` snapshots")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		return usageError(fs, "repo prune requires a repository path")
+	}
+	if *keepLast < 0 {
+		return usageError(fs, "--keep-last must not be negative")
+	}
+
+	r, err := openRepo(fs, passwordOpts, positional[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	result, err := r.Prune(repo.PruneOptions{Forget: positional[1:], KeepLast: *keepLast})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d snapshots and %d chunks, freed %d bytes\n", result.Snapshots, result.Chunks, result.Freed)
+	return nil
+}
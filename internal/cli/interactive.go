@@ -2,23 +2,60 @@
 package cli
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/c-bata/go-prompt"
-	"github.com/vsamidurai/cloak/internal/cloak"
 )
 
 // commands available in interactive mode.
 var commands = []prompt.Suggest{
-	{Text: "encrypt", Description: "Encrypt a folder into a .cloak file"},
-	{Text: "decrypt", Description: "Decrypt a .cloak file back to folder"},
+	{Text: "encrypt", Description: "Encrypt a folder or file into a .cloak file"},
+	{Text: "decrypt", Description: "Decrypt a .cloak file back to a folder or file"},
+	{Text: "restore", Description: "Restore a .cloak file and its increments"},
+	{Text: "list", Description: "List the contents of a .cloak file"},
+	{Text: "verify", Description: "Check that a .cloak file decrypts"},
+	{Text: "info", Description: "Show the header of a .cloak file"},
+	{Text: "key", Description: "Manage the key slots of a .cloak file"},
+	{Text: "passwd", Description: "Change the password of a .cloak file"},
+	{Text: "keygen", Description: "Generate an X25519 identity"},
+	{Text: "kdf", Description: "Calibrate key derivation costs"},
+	{Text: "repo", Description: "Manage a deduplicating backup repository"},
 	{Text: "help", Description: "Show available commands"},
 	{Text: "exit", Description: "Exit interactive mode"},
 }
 
+// keySubcommands available after the key command.
+var keySubcommands = []prompt.Suggest{
+	{Text: "list", Description: "List the key slots of a file"},
+	{Text: "add", Description: "Add a password, keyfile or recipient to a file"},
+	{Text: "remove", Description: "Remove a key slot from a file"},
+}
+
+// kdfSubcommands available after the kdf command.
+var kdfSubcommands = []prompt.Suggest{
+	{Text: "calibrate", Description: "Find Argon2id costs for this machine"},
+}
+
+// repoSubcommands available after the repo command.
+var repoSubcommands = []prompt.Suggest{
+	{Text: "init", Description: "Create an empty repository"},
+	{Text: "backup", Description: "Store folders and files as a new snapshot"},
+	{Text: "restore", Description: "Restore a snapshot"},
+	{Text: "snapshots", Description: "List the snapshots of a repository"},
+	{Text: "prune", Description: "Remove snapshots and unused chunks"},
+}
+
+// outputFlags take an output path, which is completed with directories.
+var outputFlags = map[string]bool{
+	"-o": true, "--output": true, "-output": true,
+	"-C": true, "--directory": true, "-directory": true,
+}
+
 // completer provides autocomplete suggestions.
 func completer(d prompt.Document) []prompt.Suggest {
 	text := d.TextBeforeCursor()
@@ -44,23 +81,56 @@ func completer(d prompt.Document) []prompt.Suggest {
 		}
 	}
 
+	// The value of an output option is completed with directories
+	previous := words[len(words)-1]
+	if !strings.HasSuffix(text, " ") {
+		previous = words[len(words)-2]
+	}
+	if outputFlags[previous] {
+		return filterDirectories(prefix)
+	}
+	if previous == "--since" {
+		return filterCloakFiles(prefix)
+	}
+
 	switch cmd {
 	case "encrypt":
-		return filterDirectories(prefix)
-	case "decrypt":
+		return filterEncryptable(prefix)
+	case "decrypt", "restore", "list", "verify", "info", "passwd":
+		return filterCloakFiles(prefix)
+	case "key":
+		if len(words) == 1 || (len(words) == 2 && !strings.HasSuffix(text, " ")) {
+			return prompt.FilterHasPrefix(keySubcommands, prefix, true)
+		}
 		return filterCloakFiles(prefix)
+	case "kdf":
+		if len(words) == 1 || (len(words) == 2 && !strings.HasSuffix(text, " ")) {
+			return prompt.FilterHasPrefix(kdfSubcommands, prefix, true)
+		}
+	case "repo":
+		if len(words) == 1 || (len(words) == 2 && !strings.HasSuffix(text, " ")) {
+			return prompt.FilterHasPrefix(repoSubcommands, prefix, true)
+		}
+		return filterDirectories(prefix)
 	}
 
 	return nil
 }
 
-// filterDirectories returns directory suggestions for encryption.
+// filterDirectories returns directory suggestions.
 func filterDirectories(prefix string) []prompt.Suggest {
 	return getPathSuggestions(prefix, func(entry os.DirEntry, path string) bool {
 		return entry.IsDir()
 	}, "Directory")
 }
 
+// filterEncryptable returns directory and file suggestions for encryption.
+func filterEncryptable(prefix string) []prompt.Suggest {
+	return getPathSuggestions(prefix, func(entry os.DirEntry, path string) bool {
+		return entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), ".cloak")
+	}, "File")
+}
+
 // filterCloakFiles returns .cloak file suggestions for decryption.
 func filterCloakFiles(prefix string) []prompt.Suggest {
 	return getPathSuggestions(prefix, func(entry os.DirEntry, path string) bool {
@@ -140,30 +210,46 @@ func executor(input string) {
 		return
 	}
 
-	words := strings.Fields(input)
+	words, err := splitArgs(input)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
 	cmd := words[0]
 
 	switch cmd {
 	case "encrypt":
-		if len(words) < 2 {
-			fmt.Println("Usage: encrypt <folder_path>")
-			fmt.Println("Example: encrypt ./my_folder")
-			return
-		}
-		path := strings.TrimSuffix(words[1], string(filepath.Separator))
-		if err := cloak.Encrypt(path); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
+		reportError(RunEncrypt(words[1:]))
 
 	case "decrypt":
-		if len(words) < 2 {
-			fmt.Println("Usage: decrypt <file_path>")
-			fmt.Println("Example: decrypt ./my_folder.cloak")
-			return
-		}
-		if err := cloak.Decrypt(words[1]); err != nil {
-			fmt.Printf("Error: %v\n", err)
-		}
+		reportError(RunDecrypt(words[1:]))
+
+	case "restore":
+		reportError(RunRestore(words[1:]))
+
+	case "list":
+		reportError(RunList(words[1:]))
+
+	case "verify":
+		reportError(RunVerify(words[1:]))
+
+	case "info":
+		reportError(RunInfo(words[1:]))
+
+	case "key":
+		reportError(RunKey(words[1:]))
+
+	case "passwd":
+		reportError(RunPasswd(words[1:]))
+
+	case "keygen":
+		reportError(RunKeygen(words[1:]))
+
+	case "kdf":
+		reportError(RunKDF(words[1:]))
+
+	case "repo":
+		reportError(RunRepo(words[1:]))
 
 	case "help":
 		printInteractiveHelp()
@@ -178,14 +264,99 @@ func executor(input string) {
 	}
 }
 
+// splitArgs splits an input line into words. Single and double quotes group
+// words containing spaces. Backslashes are kept as-is so Windows paths work.
+func splitArgs(input string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for _, r := range input {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// reportError prints a command error unless it has already been reported.
+func reportError(err error) {
+	if err == nil || errors.Is(err, flag.ErrHelp) || errors.Is(err, ErrUsage) {
+		return
+	}
+	fmt.Printf("Error: %v\n", err)
+}
+
 // printInteractiveHelp prints help for interactive mode.
 func printInteractiveHelp() {
 	fmt.Println()
 	fmt.Println("Available commands:")
-	fmt.Println("  encrypt <folder>  Encrypt a folder into a .cloak file")
-	fmt.Println("  decrypt <file>    Decrypt a .cloak file back to folder")
-	fmt.Println("  help              Show this help message")
-	fmt.Println("  exit              Exit interactive mode")
+	fmt.Println("  encrypt [options] <path>... Encrypt folders or files into a .cloak file")
+	fmt.Println("  decrypt [options] <file> [pattern...]")
+	fmt.Println("                              Decrypt a .cloak file, or only matching entries")
+	fmt.Println("  restore [options] <base> [increment...]")
+	fmt.Println("                              Restore a .cloak file and the increments made after it")
+	fmt.Println("  list [--long] <file>        List the contents of a .cloak file")
+	fmt.Println("  verify [options] <file>     Check that a .cloak file decrypts, without extracting")
+	fmt.Println("  info [--json] <file>        Show the header of a .cloak file without a password")
+	fmt.Println("  key list <file>             List the key slots of a .cloak file")
+	fmt.Println("  key add [options] <file>    Add a password, keyfile or recipient to a .cloak file")
+	fmt.Println("  key remove <file> <slot>    Remove a key slot from a .cloak file")
+	fmt.Println("  passwd [options] <file>     Change the password of a .cloak file")
+	fmt.Println("  keygen [-o file]            Generate an X25519 identity")
+	fmt.Println("  kdf calibrate [options]     Find Argon2id costs for this machine")
+	fmt.Println("  repo init|backup|restore|snapshots|prune")
+	fmt.Println("                              Manage a deduplicating backup repository")
+	fmt.Println("  help                        Show this help message")
+	fmt.Println("  exit                        Exit interactive mode")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -o, --output PATH           Write the encrypted file to PATH or into directory PATH")
+	fmt.Println("  --exclude PATTERN           Leave out matching paths, gitignore syntax (repeatable)")
+	fmt.Println("  --include PATTERN           Keep matching paths that are excluded (repeatable)")
+	fmt.Println("  --gitignore                 Also leave out the paths listed in .gitignore files")
+	fmt.Println("  --compression CODEC         Compress with gzip (default), zstd or none")
+	fmt.Println("  --level N                   Compression level: 1-9 for gzip, 1-22 for zstd")
+	fmt.Println("  --since FILE                Store only what changed since the .cloak file FILE")
+	fmt.Println("  -C, --directory DIR         Extract into DIR instead of next to the .cloak file")
+	fmt.Println("  --on-conflict POLICY        Existing files: fail (default), skip, overwrite, rename, newer")
+	fmt.Println("  --jobs N                    Number of chunks to process in parallel")
+	fmt.Println("  --password-file FILE        Read the password from a file")
+	fmt.Println("  --password-fd N             Read the password from a file descriptor")
+	fmt.Println("  --password-command CMD      Read the password from a command's output")
+	fmt.Println("  --keyfile FILE              Require a keyfile in addition to the password")
+	fmt.Println("  --no-password               Encrypt with the keyfile or recipients only")
+	fmt.Println("  --recipient KEY             Also encrypt to a public key (repeatable)")
+	fmt.Println("  --identity FILE             Decrypt with the secret key in FILE (repeatable)")
+	fmt.Println("  --kdf-profile NAME          Argon2id cost: interactive, moderate, paranoid")
+	fmt.Println("  --kdf-time N                Argon2id iterations (overrides the profile)")
+	fmt.Println("  --kdf-memory SIZE           Argon2id memory, e.g. 256MiB (overrides the profile)")
+	fmt.Println("  --kdf-threads N             Argon2id parallelism (overrides the profile)")
 	fmt.Println()
 	fmt.Println("Tips:")
 	fmt.Println("  - Press Tab for autocomplete suggestions")
@@ -196,6 +367,8 @@ func printInteractiveHelp() {
 
 // RunInteractive starts the interactive prompt.
 func RunInteractive() {
+	usageOutput = os.Stdout
+
 	fmt.Println("Cloak Interactive Mode")
 	fmt.Println("Type 'help' for commands, Tab for autocomplete, Ctrl+D to exit")
 	fmt.Println()
@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+)
+
+// progressInterval is the shortest time between two redraws of the bar.
+const progressInterval = 100 * time.Millisecond
+
+// progressOutput receives progress messages and the progress bar.
+var progressOutput = os.Stderr
+
+// progressBar shows the progress events of an operation. On a terminal the
+// encrypt and decrypt phases are drawn as a bar with the throughput and the
+// time left; elsewhere each phase is announced on a line of its own.
+type progressBar struct {
+	w     io.Writer
+	tty   bool
+	width int
+
+	// bars draws the encrypt and decrypt phases. Without it only key
+	// derivation is announced.
+	bars bool
+
+	phase   cloak.Phase
+	started time.Time
+	drawn   time.Time
+	last    cloak.ProgressEvent
+	visible bool
+}
+
+// newProgressBar returns a progress bar that writes to progressOutput. If
+// bars is false, only key derivation is shown, which suits commands that
+// print their results while they decrypt.
+func newProgressBar(bars bool) *progressBar {
+	fd := int(progressOutput.Fd())
+	b := &progressBar{w: progressOutput, tty: term.IsTerminal(fd), width: 80, bars: bars}
+	if width, _, err := term.GetSize(fd); err == nil && width > 0 {
+		b.width = width
+	}
+	return b
+}
+
+// update handles one event. It is a cloak.ProgressFunc.
+func (b *progressBar) update(e cloak.ProgressEvent) {
+	if e.Phase == cloak.PhaseDeriveKey {
+		b.finish()
+		b.phase = e.Phase
+		fmt.Fprintln(b.w, "Deriving key (this may take a moment)...")
+		return
+	}
+	if !b.bars {
+		return
+	}
+
+	// A phase starts again when the next file of a chain is read.
+	if e.Phase != b.phase || e.Done < b.last.Done {
+		b.finish()
+		b.phase = e.Phase
+		b.started = time.Now()
+		if !b.tty {
+			switch e.Phase {
+			case cloak.PhaseEncrypt:
+				fmt.Fprintln(b.w, "Archiving and encrypting...")
+			case cloak.PhaseDecrypt:
+				fmt.Fprintln(b.w, "Decrypting...")
+			}
+		}
+	}
+	b.last = e
+	if !b.tty {
+		return
+	}
+
+	if now := time.Now(); !b.visible || now.Sub(b.drawn) >= progressInterval {
+		b.draw()
+	}
+}
+
+// draw redraws the bar with the last event.
+func (b *progressBar) draw() {
+	b.drawn = time.Now()
+	b.visible = true
+	fmt.Fprintf(b.w, "\r%s\x1b[K", b.line(b.last, b.drawn.Sub(b.started)))
+}
+
+// line formats the bar for e after the phase has run for elapsed.
+func (b *progressBar) line(e cloak.ProgressEvent, elapsed time.Duration) string {
+	var rate float64
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		rate = float64(e.Done) / seconds
+	}
+
+	label := strings.ToUpper(e.Phase.String()[:1]) + e.Phase.String()[1:]
+	var s string
+	if e.Total > 0 {
+		fraction := min(float64(e.Done)/float64(e.Total), 1)
+		const barWidth = 24
+		filled := int(fraction * barWidth)
+		s = fmt.Sprintf("%s %3.0f%% [%s%s] %s / %s  %s/s", label, fraction*100,
+			strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled),
+			formatBytes(e.Done), formatBytes(e.Total), formatBytes(int64(rate)))
+		if rate > 0 && e.Done < e.Total {
+			left := time.Duration(float64(e.Total-e.Done) / rate * float64(time.Second))
+			s += "  ETA " + formatDuration(left)
+		}
+	} else {
+		s = fmt.Sprintf("%s %s  %s/s", label, formatBytes(e.Done), formatBytes(int64(rate)))
+	}
+	if e.File != "" {
+		s += "  " + e.File
+	}
+
+	// Keep the bar on one line, or \r cannot redraw it.
+	if runes := []rune(s); len(runes) > b.width-1 {
+		s = string(runes[:max(b.width-1, 0)])
+	}
+	return s
+}
+
+// finish draws the final state of a bar that is on screen and ends its
+// line.
+func (b *progressBar) finish() {
+	if b.visible {
+		b.draw()
+		fmt.Fprintln(b.w)
+		b.visible = false
+	}
+	b.last = cloak.ProgressEvent{}
+}
+
+// formatBytes formats n as a size with a binary unit, such as 12.5 MiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+// formatDuration formats d as minutes and seconds, or hours and minutes.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
@@ -3,12 +3,12 @@ package cloak
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
-	"crypto/subtle"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,13 +18,20 @@ import (
 	"runtime"
 	"strings"
 
-	"golang.org/x/crypto/argon2"
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/term"
 )
 
 const (
 	// MagicBytes identifies the file format and version.
-	MagicBytes = "CLOAK01"
+	MagicBytes = "CLOAK03"
+
+	// MagicBytesV2 identifies chunked files whose header is not
+	// authenticated.
+	MagicBytesV2 = "CLOAK02"
+
+	// MagicBytesV1 identifies the original single-ciphertext format.
+	MagicBytesV1 = "CLOAK01"
 
 	// SaltSize is the size of the salt for Argon2id (256-bit).
 	SaltSize = 32
@@ -35,7 +42,7 @@ const (
 	// KeySize is the size of the encryption key (256-bit for AES-256).
 	KeySize = 32
 
-	// Argon2id parameters (OWASP recommendations).
+	// Default Argon2id parameters (OWASP recommendations).
 	argonTime    = 3         // Number of iterations
 	argonMemory  = 64 * 1024 // 64 MB memory
 	argonThreads = 4         // Parallelism
@@ -80,10 +87,10 @@ func ReadPasswordSecure(prompt string) (*SecureBytes, error) {
 	return &SecureBytes{Data: password}, nil
 }
 
-// DeriveKey uses Argon2id to derive an encryption key from password and salt.
+// DeriveKey uses Argon2id with DefaultKDFParams to derive an encryption key
+// from password and salt.
 func DeriveKey(password, salt []byte) *SecureBytes {
-	key := argon2.IDKey(password, salt, argonTime, argonMemory, argonThreads, KeySize)
-	return &SecureBytes{Data: key}
+	return DeriveKeyWithParams(password, salt, DefaultKDFParams)
 }
 
 // GenerateRandomBytes generates cryptographically secure random bytes.
@@ -100,294 +107,1070 @@ func GenerateRandomBytes(size int) ([]byte, error) {
 func ArchiveDirectory(dirPath string) ([]byte, error) {
 	var buf bytes.Buffer
 
-	gzWriter := gzip.NewWriter(&buf)
-	tarWriter := tar.NewWriter(gzWriter)
+	if err := ArchiveDirectoryTo(&buf, dirPath); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ArchiveDirectoryTo streams a tar.gz archive of the directory to w.
+func ArchiveDirectoryTo(w io.Writer, dirPath string) error {
+	_, err := archivePaths(w, []string{dirPath}, archiveOptions{})
+	return err
+}
+
+// archiveOptions configures archivePaths.
+type archiveOptions struct {
+	// filter leaves out paths. Nil archives everything.
+	filter *ignoreFilter
+
+	// compression and level select the compressor of the tar archive.
+	compression Compression
+	level       int
 
-	baseName := filepath.Base(dirPath)
+	// manifest, if set, receives every archived path and is written as
+	// the first entry of the archive.
+	manifest *manifest
 
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	// base is the manifest of an earlier snapshot. Files and symlinks
+	// that have not changed since are listed in manifest but not stored.
+	base *manifest
+
+	// progress, if set, receives PhaseEncrypt events.
+	progress ProgressFunc
+}
+
+// archiveStats counts the paths archivePaths did not store.
+type archiveStats struct {
+	// excluded paths were left out by the filter.
+	excluded int
+
+	// unchanged paths are the same as in the base snapshot.
+	unchanged int
+}
+
+// archiveItem is a path found while scanning the folders to archive.
+type archiveItem struct {
+	path string
+	name string
+	info os.FileInfo
+	link string
+}
+
+// archivePaths streams a compressed tar archive of directories and single
+// files to w. Each path is stored under the base name of its absolute form,
+// so a relative path such as "." or ".." is stored under the folder's name.
+func archivePaths(w io.Writer, paths []string, opts archiveOptions) (archiveStats, error) {
+	var stats archiveStats
+	var items []archiveItem
+	for _, path := range paths {
+		root, err := filepath.Abs(path)
 		if err != nil {
-			return err
+			return stats, err
+		}
+		if filepath.Dir(root) == root {
+			return stats, fmt.Errorf("cannot archive the root directory %s", root)
 		}
+		n, err := scanPath(root, opts.filter.forRoot(), func(item archiveItem) {
+			items = append(items, item)
+		})
+		stats.excluded += n
+		if err != nil {
+			return stats, err
+		}
+	}
 
-		header, err := tar.FileInfoHeader(info, "")
+	// The manifest is encoded first, so an archive whose manifest is too
+	// large fails before anything is written.
+	var manifestData []byte
+	if opts.manifest != nil {
+		for _, item := range items {
+			opts.manifest.add(item)
+		}
+		opts.manifest.diff(opts.base)
+		data, err := opts.manifest.marshal()
 		if err != nil {
-			return fmt.Errorf("failed to create tar header: %w", err)
+			return stats, err
 		}
+		manifestData = data
+	}
 
-		relPath, err := filepath.Rel(filepath.Dir(dirPath), path)
+	compressor, err := opts.compression.newWriter(w, opts.level)
+	if err != nil {
+		return stats, err
+	}
+	tarWriter := tar.NewWriter(compressor)
+
+	var total int64
+	for _, item := range items {
+		if item.info.Mode().IsRegular() && !opts.base.unchanged(item) {
+			total += item.info.Size()
+		}
+	}
+	tracker := newProgressTracker(opts.progress, PhaseEncrypt, total)
+	tracker.start()
+
+	if opts.manifest != nil {
+		if err := opts.manifest.write(tarWriter, manifestData); err != nil {
+			return stats, err
+		}
+	}
+
+	for _, item := range items {
+		if opts.base.unchanged(item) {
+			stats.unchanged++
+			continue
+		}
+		tracker.setFile(item.name)
+		if err := writeItem(tarWriter, item, tracker); err != nil {
+			return stats, err
+		}
+	}
+	tracker.setFile("")
+
+	if err := tarWriter.Close(); err != nil {
+		return stats, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+
+	if err := compressor.Close(); err != nil {
+		return stats, fmt.Errorf("failed to close %s writer: %w", opts.compression, err)
+	}
+
+	return stats, nil
+}
+
+// scanPath calls fn for the directory or file at root and, for a directory,
+// every path below it, named relative to the parent of root. Excluded
+// directories are not walked. It returns the number of paths the filter
+// left out.
+func scanPath(root string, filter *ignoreFilter, fn func(archiveItem)) (int, error) {
+	excluded := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		header.Name = relPath
 
-		if info.Mode()&os.ModeSymlink != 0 {
-			link, err := os.Readlink(path)
+		if filter != nil {
+			rel, err := filepath.Rel(root, path)
 			if err != nil {
 				return err
 			}
-			header.Linkname = link
+			elems := splitPath(filepath.ToSlash(rel))
+			if filter.excluded(elems, info.IsDir()) {
+				excluded++
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if err := filter.readDir(path, elems); err != nil {
+					return fmt.Errorf("failed to read ignore file: %w", err)
+				}
+			}
 		}
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header: %w", err)
+		relPath, err := filepath.Rel(filepath.Dir(root), path)
+		if err != nil {
+			return err
 		}
+		item := archiveItem{path: path, name: relPath, info: info}
 
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if item.link, err = os.Readlink(path); err != nil {
 				return err
 			}
-			defer file.Close()
-
-			if _, err := io.Copy(tarWriter, file); err != nil {
-				return fmt.Errorf("failed to write file to archive: %w", err)
-			}
 		}
 
+		fn(item)
 		return nil
 	})
+	return excluded, err
+}
+
+// writeItem writes the tar header of item to tw, followed by the contents
+// of a regular file, which are counted by tracker. A regular file is
+// stated again once it is open, as it may have changed since the scan, and
+// exactly the size in its header is copied.
+func writeItem(tw *tar.Writer, item archiveItem, tracker *progressTracker) error {
+	info := item.info
+	var file *os.File
+	if info.Mode().IsRegular() {
+		var err error
+		if file, err = os.Open(item.path); err != nil {
+			return err
+		}
+		defer file.Close()
 
+		if info, err = file.Stat(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is no longer a regular file", item.path)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, item.link)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to create tar header: %w", err)
 	}
+	header.Name = item.name
 
-	if err := tarWriter.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header: %w", err)
 	}
 
-	if err := gzWriter.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	if file != nil {
+		if _, err := io.CopyN(tw, tracker.watch(tracker.count(file)), header.Size); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%s shrank while it was archived", item.path)
+			}
+			return fmt.Errorf("failed to write file to archive: %w", err)
+		}
 	}
 
-	fmt.Printf("Archived directory '%s' (%d bytes compressed)\n", baseName, buf.Len())
-	return buf.Bytes(), nil
+	return nil
 }
 
-// ExtractArchive extracts a tar.gz archive to the specified directory.
+// ExtractArchive extracts a tar.gz archive to the specified directory,
+// overwriting existing files.
 func ExtractArchive(data []byte, destDir string) error {
-	gzReader, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
-	}
-	defer gzReader.Close()
+	return ExtractArchiveFrom(bytes.NewReader(data), destDir)
+}
 
-	tarReader := tar.NewReader(gzReader)
+// ExtractArchiveFrom extracts a tar.gz archive read from r to the specified
+// directory, overwriting existing files.
+func ExtractArchiveFrom(r io.Reader, destDir string) error {
+	_, err := extractArchive(r, CompressionGzip, destDir, extractOptions{policy: ConflictOverwrite})
+	return err
+}
 
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
+// extractOptions configures extractArchive.
+type extractOptions struct {
+	// patterns selects the entries to extract. Nil extracts every entry.
+	patterns *patternSet
+
+	// policy handles entries whose path already exists.
+	policy ConflictPolicy
+
+	// onManifest, if set, is called as described for walkSnapshot, which
+	// decodes the entries of the manifest if manifestEntries is set.
+	onManifest      func(*manifest) error
+	manifestEntries bool
+
+	// progress, if set, is told about every entry and reports while the
+	// contents of a file are copied.
+	progress *progressTracker
+}
+
+// extractResult counts what extractArchive did with the matching entries.
+type extractResult struct {
+	extracted int
+	skipped   int
+	renamed   int
+}
+
+// extractArchive extracts the entries of a tar archive compressed with c
+// to destDir.
+func extractArchive(r io.Reader, c Compression, destDir string, opts extractOptions) (extractResult, error) {
+	var result extractResult
+	err := walkSnapshot(r, c, opts.manifestEntries, opts.onManifest, func(header *tar.Header, body io.Reader) error {
+		targetPath, err := archiveTarget(destDir, header.Name)
 		if err != nil {
-			return fmt.Errorf("failed to read tar entry: %w", err)
+			return err
 		}
 
-		cleanName := filepath.Clean(header.Name)
-		if strings.HasPrefix(cleanName, "..") || filepath.IsAbs(cleanName) {
-			return fmt.Errorf("invalid path in archive: %s", header.Name)
+		if !opts.patterns.match(header.Name) {
+			return nil
 		}
+		opts.progress.setFile(header.Name)
 
-		targetPath := filepath.Join(destDir, cleanName)
-
-		switch header.Typeflag {
-		case tar.TypeDir:
+		if header.Typeflag == tar.TypeDir {
 			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
 				return fmt.Errorf("failed to create directory: %w", err)
 			}
+			result.extracted++
+			return nil
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			return nil
+		}
 
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return err
-			}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return err
+		}
+		path, err := opts.policy.resolveConflict(targetPath, header)
+		if err != nil {
+			return err
+		}
+		switch path {
+		case "":
+			result.skipped++
+			return nil
+		case targetPath:
+			result.extracted++
+		default:
+			result.renamed++
+		}
 
-			file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+		if header.Typeflag == tar.TypeSymlink {
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
 			}
+			return nil
+		}
 
-			if _, err := io.Copy(file, tarReader); err != nil {
-				file.Close()
-				return fmt.Errorf("failed to write file: %w", err)
-			}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode))
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+
+		if _, err := io.Copy(file, opts.progress.watch(body)); err != nil {
 			file.Close()
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+		return file.Close()
+	})
+	return result, err
+}
 
-		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return err
-			}
+// walkArchive calls fn for every entry of the tar archive compressed with c
+// read from r, with a reader of the entry's contents. The snapshot manifest
+// is skipped.
+func walkArchive(r io.Reader, c Compression, fn func(header *tar.Header, body io.Reader) error) error {
+	return walkSnapshot(r, c, false, nil, fn)
+}
 
-			os.Remove(targetPath)
-			if err := os.Symlink(header.Linkname, targetPath); err != nil {
-				return fmt.Errorf("failed to create symlink: %w", err)
+// walkSnapshot is like walkArchive, but first calls onManifest, if set,
+// with the snapshot manifest of the archive, or with nil if the archive has
+// none. The body of the manifest is only decoded if entries is set;
+// otherwise onManifest receives just its ids, without entries or deleted
+// paths.
+func walkSnapshot(r io.Reader, c Compression, entries bool, onManifest func(*manifest) error, fn func(header *tar.Header, body io.Reader) error) error {
+	decompressor, err := c.newReader(r)
+	if err != nil {
+		return archiveError(fmt.Sprintf("failed to create %s reader", c), err)
+	}
+	defer decompressor.Close()
+
+	tarReader := tar.NewReader(decompressor)
+
+	first := true
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archiveError("failed to read tar entry", err)
+		}
+
+		if first {
+			first = false
+			if header.Name == manifestName {
+				if onManifest == nil {
+					continue
+				}
+				var m *manifest
+				if entries {
+					m, err = parseManifest(tarReader)
+				} else {
+					m, err = manifestIDs(header)
+				}
+				if err != nil {
+					return err
+				}
+				if err := onManifest(m); err != nil {
+					return err
+				}
+				continue
+			}
+			if onManifest != nil {
+				if err := onManifest(nil); err != nil {
+					return err
+				}
 			}
 		}
+
+		if err := fn(header, tarReader); err != nil {
+			return err
+		}
+	}
+
+	if first && onManifest != nil {
+		if err := onManifest(nil); err != nil {
+			return err
+		}
+	}
+
+	// Read through the compressed trailer so its checksum is verified and,
+	// for streamed input, every remaining chunk is authenticated.
+	if _, err := io.Copy(io.Discard, decompressor); err != nil {
+		return archiveError("failed to read archive", err)
 	}
 
 	return nil
 }
 
-// EncryptData encrypts data using AES-256-GCM.
-func EncryptData(plaintext, key, nonce []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+// archiveError adds context to an error met while reading an archive. A
+// malformed compressed or tar stream is reported as ErrCorrupted.
+func archiveError(msg string, err error) error {
+	switch {
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum),
+		errors.Is(err, zstd.ErrMagicMismatch), errors.Is(err, zstd.ErrCRCMismatch),
+		errors.Is(err, tar.ErrHeader), errors.Is(err, io.ErrUnexpectedEOF):
+		return errorf(ErrCorrupted, "%s: %v", msg, err)
+	default:
+		return fmt.Errorf("%s: %w", msg, err)
 	}
+}
 
-	gcm, err := cipher.NewGCM(block)
+// EncryptData encrypts data using AES-256-GCM.
+func EncryptData(plaintext, key, nonce []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
 	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
 	return ciphertext, nil
 }
 
-// DecryptData decrypts data using AES-256-GCM.
+// DecryptData decrypts data using AES-256-GCM. It fails with errAuthFailed
+// if the key is wrong or the ciphertext was modified, which AES-GCM cannot
+// tell apart; KeyCheck can be used to check the key first.
 func DecryptData(ciphertext, key, nonce []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+	gcm, err := newGCM(key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, errors.New("decryption failed: invalid password or corrupted file")
+		return nil, errAuthFailed
 	}
 
 	return plaintext, nil
 }
 
-// Encrypt encrypts a folder and writes the encrypted output to a .cloak file.
-func Encrypt(folderPath string) error {
-	info, err := os.Stat(folderPath)
-	if err != nil {
-		return fmt.Errorf("cannot access folder: %w", err)
+// errAuthFailed is returned by DecryptData for data that fails
+// authentication.
+var errAuthFailed = errors.New("decryption failed: message authentication failed")
+
+// KeyCheckSize is the size of a key check value.
+const KeyCheckSize = 16
+
+// keyCheckInfo separates key check values from other values derived from a
+// key.
+const keyCheckInfo = "cloak key check"
+
+// KeyCheck returns the key check value of key: a short value derived from
+// it, stored next to data encrypted with the key, that tells a wrong key
+// apart from damaged data without revealing the key.
+func KeyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyCheckInfo))
+	return mac.Sum(nil)[:KeyCheckSize]
+}
+
+// EncryptOptions configures Encrypt.
+type EncryptOptions struct {
+	// Password supplies the encryption password. Nil reads it from the
+	// terminal.
+	Password PasswordProvider
+
+	// Keyfile is the path of a keyfile that is required, in addition to
+	// the password, to decrypt the file.
+	Keyfile string
+
+	// NoPassword leaves out the password. The file is then protected by
+	// the keyfile alone, or only by the recipients.
+	NoPassword bool
+
+	// Recipients are X25519 public keys that can decrypt the file with
+	// their identity. Each gets its own key slot.
+	Recipients []*Recipient
+
+	// KDF holds the Argon2id parameters of the password slot. The zero
+	// value uses DefaultKDFParams.
+	KDF KDFParams
+
+	// Exclude lists paths to leave out of the archive, in gitignore
+	// syntax, relative to the folder. They apply on top of the
+	// .cloakignore files in the folder.
+	Exclude []string
+
+	// Include lists paths to archive even though Exclude or an ignore
+	// file leaves them out. Paths inside an excluded directory cannot be
+	// included again.
+	Include []string
+
+	// GitIgnore also applies the .gitignore files in the folder.
+	GitIgnore bool
+
+	// Compression selects the compressor of the archive. The zero value
+	// is gzip.
+	Compression Compression
+
+	// CompressionLevel is the compression level. Zero uses the default of
+	// the compressor.
+	CompressionLevel int
+
+	// Output is the path of the .cloak file to write. If it names an
+	// existing directory, the file is written there under its default
+	// name. Empty writes <name>.cloak next to the folder or file; the
+	// default name comes from the first path given to EncryptPaths.
+	Output string
+
+	// Since is the path of an earlier .cloak file. If set, only the files
+	// that were added or changed since that snapshot are stored, together
+	// with a list of the deleted paths. Restore applies the result on top
+	// of the earlier file. Password, Keyfile and Identities unlock it, and
+	// a password is only asked for once.
+	Since string
+
+	// Identities are X25519 secret keys tried against the recipient slots
+	// of the Since file.
+	Identities []*Identity
+
+	// Jobs is the number of chunks encrypted in parallel. Zero uses one
+	// worker per CPU.
+	Jobs int
+
+	// Progress, if set, is told when keys are derived and how many bytes
+	// have been archived.
+	Progress ProgressFunc
+}
+
+// EncryptResult summarizes a file written by Encrypt.
+type EncryptResult struct {
+	// Output is the absolute path of the .cloak file.
+	Output string
+
+	// Excluded is the number of paths left out by the ignore rules.
+	Excluded int
+
+	// Unchanged and Deleted count the paths that were left out because
+	// they have not changed since the Since file, and the paths recorded
+	// as deleted since then.
+	Unchanged int
+	Deleted   int
+
+	// ArchiveSize is the size of the compressed archive and EncryptedSize
+	// the size of the .cloak file, in bytes.
+	ArchiveSize   int64
+	EncryptedSize int64
+}
+
+// DecryptOptions configures Decrypt.
+type DecryptOptions struct {
+	// Password supplies the decryption password. Nil reads it from the
+	// terminal. It is only used if the file requires a password.
+	Password PasswordProvider
+
+	// Keyfile is the path of the keyfile. It is only used if the file
+	// requires a keyfile.
+	Keyfile string
+
+	// Identities are X25519 secret keys tried against the recipient slots
+	// of the file.
+	Identities []*Identity
+
+	// Patterns, if set, limits extraction to the archive entries that
+	// match at least one of them. Patterns use / as the separator, may
+	// contain * ? [...] and ** wildcards, and select everything below a
+	// matching directory. A pattern that matches nothing is an error.
+	Patterns []string
+
+	// OnConflict decides what Decrypt does with an entry whose path
+	// already exists. The zero value, ConflictFail, stops with an error.
+	OnConflict ConflictPolicy
+
+	// Directory is the directory Decrypt extracts into. It is created if
+	// needed. Empty uses the directory that contains the .cloak file.
+	Directory string
+
+	// Jobs is the number of chunks decrypted in parallel. Zero uses one
+	// worker per CPU.
+	Jobs int
+
+	// Progress, if set, is told when keys are derived and how much of the
+	// file has been decrypted.
+	Progress ProgressFunc
+}
+
+// DecryptResult summarizes what Decrypt extracted.
+type DecryptResult struct {
+	// Directory is the absolute path of the directory extracted into.
+	Directory string
+
+	// Extracted is the number of entries written, including the renamed
+	// ones. Skipped and Renamed count the entries whose path already
+	// existed and that were skipped or written under a new name.
+	Extracted int
+	Skipped   int
+	Renamed   int
+
+	// Incremental reports that the file is an increment, which only
+	// holds the changes since its base; Restore applies it to the base.
+	Incremental bool
+}
+
+// Encrypt encrypts a folder, or a single regular file, and writes the
+// encrypted output to a .cloak file. A file is stored as an archive with one
+// entry, so Decrypt restores it like a folder.
+func Encrypt(srcPath string, opts EncryptOptions) (EncryptResult, error) {
+	return EncryptPaths([]string{srcPath}, opts)
+}
+
+// EncryptPaths encrypts several folders and regular files into one .cloak
+// file. Each path is stored under its base name, so the names must differ.
+// Output is required when more than one path is given.
+func EncryptPaths(srcPaths []string, opts EncryptOptions) (EncryptResult, error) {
+	if len(srcPaths) == 0 {
+		return EncryptResult{}, errors.New("no paths to encrypt")
 	}
-	if !info.IsDir() {
-		return errors.New("path is not a directory")
+	if len(srcPaths) > 1 && opts.Output == "" {
+		return EncryptResult{}, errors.New("an output file is required to encrypt several paths")
+	}
+
+	names := make(map[string]string, len(srcPaths))
+	var dirs []string
+	for _, srcPath := range srcPaths {
+		info, err := os.Stat(srcPath)
+		if err != nil {
+			return EncryptResult{}, fmt.Errorf("cannot access path: %w", err)
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return EncryptResult{}, fmt.Errorf("path is not a directory or regular file: %s", srcPath)
+		}
+
+		absPath, err := filepath.Abs(srcPath)
+		if err != nil {
+			return EncryptResult{}, err
+		}
+		name := filepath.Base(absPath)
+		if name == manifestName {
+			return EncryptResult{}, fmt.Errorf("%s cannot be stored under the reserved name %q", srcPath, name)
+		}
+		if other, ok := names[name]; ok {
+			return EncryptResult{}, fmt.Errorf("%s and %s would both be stored as %q", other, srcPath, name)
+		}
+		names[name] = srcPath
+		if info.IsDir() {
+			dirs = append(dirs, absPath)
+		}
 	}
 
-	absPath, err := filepath.Abs(folderPath)
+	outputPath, err := encryptOutputPath(srcPaths[0], opts.Output)
 	if err != nil {
-		return err
+		return EncryptResult{}, err
+	}
+	for _, dir := range dirs {
+		if isWithin(dir, outputPath) {
+			return EncryptResult{}, fmt.Errorf("output file cannot be inside a folder being encrypted: %s", outputPath)
+		}
 	}
-	outputPath := strings.TrimSuffix(absPath, string(filepath.Separator)) + ".cloak"
 
 	if _, err := os.Stat(outputPath); err == nil {
-		return fmt.Errorf("output file already exists: %s", outputPath)
+		return EncryptResult{}, fmt.Errorf("output file already exists: %s", outputPath)
 	}
 
-	password, err := ReadPasswordSecure("Enter encryption password: ")
+	filter, err := newIgnoreFilter(opts.Exclude, opts.Include, opts.GitIgnore)
 	if err != nil {
-		return err
+		return EncryptResult{}, err
+	}
+	if err := opts.Compression.ValidateLevel(opts.CompressionLevel); err != nil {
+		return EncryptResult{}, err
 	}
-	defer password.Wipe()
 
-	confirmPassword, err := ReadPasswordSecure("Confirm password: ")
+	snapshot, err := newManifest()
 	if err != nil {
-		return err
+		return EncryptResult{}, err
+	}
+	var base *manifest
+	if opts.Since != "" {
+		password := &cachedPassword{p: passwordProvider(opts.Password)}
+		defer password.Wipe()
+		opts.Password = password
+
+		base, err = readManifest(opts.Since, DecryptOptions{
+			Password:   password,
+			Keyfile:    opts.Keyfile,
+			Identities: opts.Identities,
+			Jobs:       opts.Jobs,
+			Progress:   opts.Progress,
+		})
+		if err != nil {
+			return EncryptResult{}, err
+		}
 	}
-	defer confirmPassword.Wipe()
 
-	if subtle.ConstantTimeCompare(password.Data, confirmPassword.Data) != 1 {
-		return errors.New("passwords do not match")
+	factors := selectFactors(opts.NoPassword, opts.Keyfile)
+	kdf, err := checkKeys(factors, opts.Recipients, opts.KDF)
+	if err != nil {
+		return EncryptResult{}, err
 	}
 
-	fmt.Println("Archiving directory...")
+	var secret *SecureBytes
+	if factors != 0 {
+		secret, err = readFactors(factors, opts.Password, opts.Keyfile, "Enter encryption password: ", true)
+		if err != nil {
+			return EncryptResult{}, err
+		}
+		defer secret.Wipe()
 
-	archive, err := ArchiveDirectory(folderPath)
+		opts.Progress.report(ProgressEvent{Phase: PhaseDeriveKey})
+	}
+
+	key, header, err := newFileKey(factors, secret, opts.Recipients, kdf)
 	if err != nil {
-		return fmt.Errorf("failed to archive directory: %w", err)
+		return EncryptResult{}, err
 	}
+	defer key.Wipe()
+	header.Compression = opts.Compression
+
+	outFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return EncryptResult{}, fmt.Errorf("failed to create output file: %w", err)
+	}
+	success := false
+	defer func() {
+		outFile.Close()
+		if !success {
+			os.Remove(outputPath)
+		}
+	}()
 
-	salt, err := GenerateRandomBytes(SaltSize)
+	encrypted := &countingWriter{w: outFile}
+	stream, err := newPayloadWriter(encrypted, key.Data, header, opts.Jobs)
 	if err != nil {
-		return err
+		return EncryptResult{}, err
 	}
 
-	nonce, err := GenerateRandomBytes(NonceSize)
+	archive := &countingWriter{w: stream}
+	stats, err := archivePaths(archive, srcPaths, archiveOptions{
+		filter:      filter,
+		compression: opts.Compression,
+		level:       opts.CompressionLevel,
+		manifest:    snapshot,
+		base:        base,
+		progress:    opts.Progress,
+	})
 	if err != nil {
-		return err
+		stream.Close()
+		return EncryptResult{}, fmt.Errorf("failed to archive: %w", err)
 	}
 
-	fmt.Println("Deriving encryption key (this may take a moment)...")
+	if err := stream.Close(); err != nil {
+		return EncryptResult{}, fmt.Errorf("failed to encrypt data: %w", err)
+	}
 
-	key := DeriveKey(password.Data, salt)
-	defer key.Wipe()
+	if err := outFile.Close(); err != nil {
+		return EncryptResult{}, fmt.Errorf("failed to write output file: %w", err)
+	}
+	success = true
+
+	return EncryptResult{
+		Output:        outputPath,
+		Excluded:      stats.excluded,
+		Unchanged:     stats.unchanged,
+		Deleted:       len(snapshot.Deleted),
+		ArchiveSize:   archive.n,
+		EncryptedSize: encrypted.n,
+	}, nil
+}
 
-	fmt.Println("Encrypting data...")
+// checkKeys validates the key options of a new file before any secret is
+// read, and returns the KDF parameters to use.
+func checkKeys(factors uint8, recipients []*Recipient, kdf KDFParams) (KDFParams, error) {
+	if factors == 0 && len(recipients) == 0 {
+		return KDFParams{}, errors.New("a keyfile or recipient is required when no password is used")
+	}
+	if n := len(recipients); n > MaxKeySlots || (factors != 0 && n >= MaxKeySlots) {
+		return KDFParams{}, fmt.Errorf("too many recipients: a file has at most %d key slots", MaxKeySlots)
+	}
+	kdf = kdf.orDefault()
+	if err := kdf.Validate(); err != nil {
+		return KDFParams{}, err
+	}
+	return kdf, nil
+}
 
-	ciphertext, err := EncryptData(archive, key.Data, nonce)
+// newFileKey generates the data key of a new file and returns it with the
+// header of the file. The key is sealed in a passphrase slot for secret if
+// factors is set, and in a slot for every recipient.
+func newFileKey(factors uint8, secret *SecureBytes, recipients []*Recipient, kdf KDFParams) (*SecureBytes, *Header, error) {
+	dataKey, err := GenerateRandomBytes(KeySize)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	key := &SecureBytes{Data: dataKey}
 
-	for i := range archive {
-		archive[i] = 0
+	noncePrefix, err := GenerateRandomBytes(noncePrefixSize)
+	if err != nil {
+		key.Wipe()
+		return nil, nil, err
 	}
 
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	var slots []KeySlot
+	if factors != 0 {
+		slot, err := sealPassphraseSlot(key.Data, factors, secret.Data, kdf)
+		if err != nil {
+			key.Wipe()
+			return nil, nil, err
+		}
+		slots = append(slots, slot)
 	}
-	defer outFile.Close()
 
-	if _, err := outFile.Write([]byte(MagicBytes)); err != nil {
-		return err
+	for _, recipient := range recipients {
+		slot, err := sealRecipientSlot(key.Data, recipient)
+		if err != nil {
+			key.Wipe()
+			return nil, nil, err
+		}
+		slots = append(slots, slot)
 	}
-	if _, err := outFile.Write(salt); err != nil {
-		return err
+
+	return key, &Header{
+		Version:     CurrentVersion,
+		ChunkSize:   DefaultChunkSize,
+		NoncePrefix: noncePrefix,
+		Slots:       slots,
+	}, nil
+}
+
+// newPayloadWriter writes header, sealed with key, to dst and returns a
+// writer that encrypts the payload that follows it.
+func newPayloadWriter(dst io.Writer, key []byte, header *Header, jobs int) (*StreamWriter, error) {
+	headerBytes, err := header.marshalSealed(key)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := outFile.Write(nonce); err != nil {
-		return err
+	if _, err := dst.Write(headerBytes); err != nil {
+		return nil, err
 	}
+	return NewStreamWriter(dst, key, header.NoncePrefix, header.associatedData(), int(header.ChunkSize), jobs)
+}
 
-	sizeBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(sizeBytes, uint64(len(ciphertext)))
-	if _, err := outFile.Write(sizeBytes); err != nil {
-		return err
+// encryptOutputPath returns the absolute path of the file that encrypts the
+// folder or file at srcPath, given the Output option.
+func encryptOutputPath(srcPath, output string) (string, error) {
+	absPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(absPath) + ".cloak"
+	if output == "" {
+		return filepath.Join(filepath.Dir(absPath), name), nil
 	}
 
-	if _, err := outFile.Write(ciphertext); err != nil {
-		return err
+	outputPath, err := filepath.Abs(output)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		outputPath = filepath.Join(outputPath, name)
 	}
+	return outputPath, nil
+}
 
-	fmt.Printf("Successfully encrypted to: %s\n", outputPath)
-	fmt.Printf("Original size: %d bytes, Encrypted size: %d bytes\n", len(archive), len(ciphertext))
-	return nil
+// isWithin reports whether path is dir or lies below it. Both paths must be
+// absolute.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 // Decrypt decrypts a .cloak file and extracts the contents.
-func Decrypt(filePath string) error {
-	info, err := os.Stat(filePath)
+func Decrypt(filePath string, opts DecryptOptions) (DecryptResult, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return DecryptResult{}, err
+	}
+	outputDir := filepath.Dir(absPath)
+	if opts.Directory != "" {
+		if outputDir, err = filepath.Abs(opts.Directory); err != nil {
+			return DecryptResult{}, err
+		}
+	}
+
+	patterns, err := newPatternSet(opts.Patterns)
+	if err != nil {
+		return DecryptResult{}, err
+	}
+	if !opts.OnConflict.valid() {
+		return DecryptResult{}, fmt.Errorf("unknown conflict policy %s", opts.OnConflict)
+	}
+
+	archive, err := openPayload(filePath, opts)
+	if err != nil {
+		return DecryptResult{}, err
+	}
+	defer archive.Close()
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return DecryptResult{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	incremental := false
+	result, err := extractArchive(archive, archive.compression, outputDir, extractOptions{
+		patterns: patterns,
+		policy:   opts.OnConflict,
+		onManifest: func(m *manifest) error {
+			incremental = m != nil && m.Parent != ""
+			return nil
+		},
+		progress: archive.progress,
+	})
 	if err != nil {
-		return fmt.Errorf("cannot access file: %w", err)
+		return DecryptResult{}, fmt.Errorf("failed to extract archive: %w", err)
+	}
+
+	archive.progress.setFile("")
+
+	if unmatched := patterns.unmatched(); len(unmatched) > 0 {
+		return DecryptResult{}, fmt.Errorf("no entries match: %s", strings.Join(unmatched, ", "))
+	}
+
+	return DecryptResult{
+		Directory:   outputDir,
+		Extracted:   result.extracted + result.renamed,
+		Skipped:     result.skipped,
+		Renamed:     result.renamed,
+		Incremental: incremental,
+	}, nil
+}
+
+// openPayload unlocks the .cloak file at path and returns a reader of the
+// decrypted, still compressed archive. Data is only returned once it has
+// been authenticated, and reading to the end verifies the whole file.
+func openPayload(path string, opts DecryptOptions) (*payloadReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access file: %w", err)
 	}
 	if info.IsDir() {
-		return errors.New("path is a directory, expected encrypted file")
+		return nil, errors.New("path is a directory, expected encrypted file")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	success := false
+	defer func() {
+		if !success {
+			file.Close()
+		}
+	}()
+
+	// The tracker counts the encrypted bytes read from the file, which
+	// are known in advance, rather than the decrypted ones.
+	tracker := newProgressTracker(opts.Progress, PhaseDecrypt, info.Size())
+	src := bufio.NewReader(tracker.count(file))
+	magic, _ := src.Peek(len(MagicBytes))
+	version, err := formatVersion(magic)
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 {
+		archive, err := openV1(src, opts)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+		success = true
+		tracker.start()
+		return &payloadReader{Reader: archive, compression: CompressionGzip, closer: archive, progress: tracker}, nil
 	}
 
-	data, err := os.ReadFile(filePath)
+	header, err := ReadHeader(src)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %w", err)
+		return nil, err
+	}
+	if header.Stream {
+		return nil, errors.New("this file holds a data stream, not an archive; read it with NewDecryptingReader")
 	}
 
-	headerSize := len(MagicBytes) + SaltSize + NonceSize + 8
-	if len(data) < headerSize {
-		return errors.New("invalid file: too small to be a valid encrypted file")
+	stream, err := openStream(src, header, credentials{
+		password:   opts.Password,
+		keyfile:    opts.Keyfile,
+		identities: opts.Identities,
+		prompt:     "Enter decryption password: ",
+		progress:   opts.Progress,
+	}, opts.Jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	success = true
+	tracker.start()
+	return &payloadReader{Reader: stream, compression: header.Compression, closer: stream, file: file, progress: tracker}, nil
+}
+
+// openStream unlocks the chunked file whose header was read from src and
+// returns a reader of the decrypted payload that follows.
+func openStream(src io.Reader, header *Header, creds credentials, jobs int) (*StreamReader, error) {
+	key, _, err := unlockKey(header, creds)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+
+	if err := header.verify(key.Data); err != nil {
+		return nil, err
+	}
+
+	stream, err := NewStreamReader(src, key.Data, header.NoncePrefix, header.associatedData(), int(header.ChunkSize), jobs)
+	if err != nil {
+		return nil, err
+	}
+	// Without key slots nothing checks the key before the first chunk.
+	stream.uncheckedKey = len(header.Slots) == 0
+	return stream, nil
+}
+
+// payloadReader reads the decrypted payload of a file and closes the file
+// together with the decrypting reader.
+type payloadReader struct {
+	io.Reader
+
+	// compression is the compressor of the archive in the payload.
+	compression Compression
+
+	// progress counts the bytes read from the file. It is nil if no
+	// progress is reported.
+	progress *progressTracker
+
+	closer io.Closer
+	file   *os.File
+}
+
+func (p *payloadReader) Close() error {
+	err := p.closer.Close()
+	if p.file != nil {
+		if fileErr := p.file.Close(); err == nil {
+			err = fileErr
+		}
+	}
+	return err
+}
+
+// openV1 decrypts a CLOAK01 file, which holds the whole archive as a single
+// ciphertext, and returns a reader of the archive.
+func openV1(r io.Reader, opts DecryptOptions) (*wipingReader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	if string(data[:len(MagicBytes)]) != MagicBytes {
-		return errors.New("invalid file: not a valid .cloak file")
+	headerSize := len(MagicBytesV1) + SaltSize + NonceSize + 8
+	if len(data) < headerSize {
+		return nil, errorf(ErrTruncated, "invalid file: too small to be a valid encrypted file")
 	}
 
-	offset := len(MagicBytes)
+	offset := len(MagicBytesV1)
 	salt := data[offset : offset+SaltSize]
 	offset += SaltSize
 
@@ -399,44 +1182,61 @@ func Decrypt(filePath string) error {
 
 	ciphertext := data[offset:]
 
+	if uint64(len(ciphertext)) < expectedSize {
+		return nil, errorf(ErrTruncated, "invalid file: size mismatch, file is truncated")
+	}
 	if uint64(len(ciphertext)) != expectedSize {
-		return errors.New("invalid file: size mismatch, file may be corrupted")
+		return nil, errorf(ErrCorrupted, "invalid file: size mismatch, file may be corrupted")
 	}
 
-	password, err := ReadPasswordSecure("Enter decryption password: ")
+	password, err := passwordProvider(opts.Password).Password("Enter decryption password: ", false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer password.Wipe()
 
-	fmt.Println("Deriving decryption key (this may take a moment)...")
+	opts.Progress.report(ProgressEvent{Phase: PhaseDeriveKey})
 
 	key := DeriveKey(password.Data, salt)
 	defer key.Wipe()
 
-	fmt.Println("Decrypting data...")
-
+	// CLOAK01 files have no key check, so a wrong password cannot be told
+	// apart from a damaged file.
 	archive, err := DecryptData(ciphertext, key.Data, nonce)
 	if err != nil {
-		return err
+		return nil, errorf(ErrWrongPassword, "decryption failed: invalid password or corrupted file")
 	}
 
-	absPath, err := filepath.Abs(filePath)
-	if err != nil {
-		return err
-	}
-	outputDir := filepath.Dir(absPath)
+	return &wipingReader{Reader: bytes.NewReader(archive), data: archive}, nil
+}
 
-	fmt.Println("Extracting files...")
+// wipingReader reads an in-memory plaintext and wipes it on Close.
+type wipingReader struct {
+	*bytes.Reader
+	data []byte
+}
 
-	if err := ExtractArchive(archive, outputDir); err != nil {
-		return fmt.Errorf("failed to extract archive: %w", err)
-	}
+func (w *wipingReader) Close() error {
+	wipeBytes(w.data)
+	return nil
+}
 
-	for i := range archive {
-		archive[i] = 0
+// passwordProvider returns p, or a TerminalPassword if p is nil.
+func passwordProvider(p PasswordProvider) PasswordProvider {
+	if p == nil {
+		return TerminalPassword{}
 	}
+	return p
+}
 
-	fmt.Printf("Successfully decrypted to: %s\n", outputDir)
-	return nil
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
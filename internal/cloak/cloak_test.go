@@ -1,8 +1,10 @@
 package cloak
 
 import (
+	"archive/tar"
 	"bytes"
 	"crypto/rand"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -111,6 +113,54 @@ func TestArchiveAndExtract(t *testing.T) {
 	}
 }
 
+func TestArchiveFileChangedAfterScan(t *testing.T) {
+	testDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "grows.txt"), []byte("short"), 0644)
+	os.WriteFile(filepath.Join(testDir, "shrinks.txt"), []byte("long content"), 0644)
+
+	var items []archiveItem
+	if _, err := scanPath(testDir, nil, func(item archiveItem) {
+		items = append(items, item)
+	}); err != nil {
+		t.Fatalf("scanPath failed: %v", err)
+	}
+
+	want := map[string]string{
+		"data/grows.txt":   "short, then a good deal longer",
+		"data/shrinks.txt": "short",
+	}
+	for name, content := range want {
+		os.WriteFile(filepath.Join(filepath.Dir(testDir), name), []byte(content), 0644)
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, item := range items {
+		if err := writeItem(tw, item, nil); err != nil {
+			t.Fatalf("writeItem %s failed: %v", item.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+
+	tr := tar.NewReader(&archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		if expected, ok := want[header.Name]; ok && string(content) != expected {
+			t.Errorf("%s: got %q, expected %q", header.Name, content, expected)
+		}
+	}
+}
+
 func TestSecureBytesWipe(t *testing.T) {
 	data := []byte("sensitive data here")
 	original := make([]byte, len(data))
@@ -228,3 +278,173 @@ func TestPathTraversalPrevention(t *testing.T) {
 	// This test ensures that malicious paths in archives are rejected
 	// The ExtractArchive function checks for ".." prefixes and absolute paths
 }
+
+func TestEncryptDecryptFile(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "project")
+	os.MkdirAll(filepath.Join(testDir, "subdir"), 0755)
+	os.WriteFile(filepath.Join(testDir, "secret.txt"), []byte("top secret data"), 0644)
+	os.WriteFile(filepath.Join(testDir, "subdir", "nested.txt"), []byte("nested data"), 0644)
+
+	passwordFile := filepath.Join(tempDir, "password")
+	os.WriteFile(passwordFile, []byte("file-password\n"), 0600)
+	password := FilePassword{Path: passwordFile}
+
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, Jobs: 2}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	encrypted := filepath.Join(tempDir, "project.cloak")
+	restoreDir := t.TempDir()
+	moved := filepath.Join(restoreDir, "project.cloak")
+	if err := os.Rename(encrypted, moved); err != nil {
+		t.Fatalf("Failed to move encrypted file: %v", err)
+	}
+
+	if _, err := Decrypt(moved, DecryptOptions{Password: password, Jobs: 2}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(restoreDir, "project", "subdir", "nested.txt"))
+	if string(content) != "nested data" {
+		t.Errorf("Content mismatch: %s", content)
+	}
+
+	wrongFile := filepath.Join(tempDir, "wrong")
+	os.WriteFile(wrongFile, []byte("wrong-password\n"), 0600)
+	if _, err := Decrypt(moved, DecryptOptions{Password: FilePassword{Path: wrongFile}}); err == nil {
+		t.Error("Decrypt should fail with the wrong password")
+	}
+}
+
+func TestEncryptDecryptOutputPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "project")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "secret.txt"), []byte("top secret data"), 0644)
+	password := writePasswordFile(t, "password")
+
+	backupDir := t.TempDir()
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: backupDir}); err != nil {
+		t.Fatalf("Encrypt to a directory failed: %v", err)
+	}
+	encrypted := filepath.Join(backupDir, "project.cloak")
+
+	named := filepath.Join(backupDir, "named.cloak")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: named}); err != nil {
+		t.Fatalf("Encrypt to a file failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "project.cloak")); !os.IsNotExist(err) {
+		t.Error("Encrypt should not write next to the folder when an output is given")
+	}
+
+	inside := filepath.Join(testDir, "self.cloak")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: inside}); err == nil {
+		t.Error("Encrypt should refuse to write into the folder being encrypted")
+	}
+
+	restoreDir := filepath.Join(t.TempDir(), "scratch", "restore")
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: password, Directory: restoreDir}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(restoreDir, "project", "secret.txt"))
+	if string(content) != "top secret data" {
+		t.Errorf("Content mismatch: %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(backupDir, "project")); !os.IsNotExist(err) {
+		t.Error("Decrypt should not extract next to the file when a directory is given")
+	}
+}
+
+func TestEncryptDecryptSingleFile(t *testing.T) {
+	tempDir := t.TempDir()
+	dump := filepath.Join(tempDir, "db.sql")
+	os.WriteFile(dump, []byte("CREATE TABLE secrets;"), 0600)
+	password := writePasswordFile(t, "password")
+
+	if _, err := Encrypt(dump, EncryptOptions{Password: password, KDF: fastKDF}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	encrypted := dump + ".cloak"
+
+	var names []string
+	List(encrypted, DecryptOptions{Password: password}, func(e Entry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if len(names) != 1 || names[0] != "db.sql" {
+		t.Errorf("Expected a single db.sql entry, got %v", names)
+	}
+
+	restoreDir := t.TempDir()
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: password, Directory: restoreDir}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	restored := filepath.Join(restoreDir, "db.sql")
+	content, _ := os.ReadFile(restored)
+	if string(content) != "CREATE TABLE secrets;" {
+		t.Errorf("Content mismatch: %s", content)
+	}
+	if info, err := os.Stat(restored); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode())
+	}
+}
+
+func TestEncryptPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"dirA", "dirB", filepath.Join("other", "dirA")} {
+		os.MkdirAll(filepath.Join(tempDir, name), 0755)
+		os.WriteFile(filepath.Join(tempDir, name, "file.txt"), []byte(name), 0644)
+	}
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("notes"), 0644)
+	password := writePasswordFile(t, "password")
+
+	paths := []string{filepath.Join(tempDir, "dirA"), filepath.Join(tempDir, "dirB"), filepath.Join(tempDir, "notes.txt")}
+	bundle := filepath.Join(tempDir, "bundle.cloak")
+	if _, err := EncryptPaths(paths, EncryptOptions{Password: password, KDF: fastKDF, Output: bundle}); err != nil {
+		t.Fatalf("EncryptPaths failed: %v", err)
+	}
+
+	restoreDir := t.TempDir()
+	if _, err := Decrypt(bundle, DecryptOptions{Password: password, Directory: restoreDir}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	for name, want := range map[string]string{"dirA/file.txt": "dirA", "dirB/file.txt": "dirB", "notes.txt": "notes"} {
+		content, _ := os.ReadFile(filepath.Join(restoreDir, filepath.FromSlash(name)))
+		if string(content) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, content)
+		}
+	}
+
+	collision := []string{filepath.Join(tempDir, "dirA"), filepath.Join(tempDir, "other", "dirA")}
+	_, err := EncryptPaths(collision, EncryptOptions{Password: password, KDF: fastKDF, Output: filepath.Join(tempDir, "collision.cloak")})
+	if err == nil {
+		t.Error("Expected error for paths with the same name")
+	}
+	if _, err := EncryptPaths(paths, EncryptOptions{Password: password, KDF: fastKDF}); err == nil {
+		t.Error("Expected error without an output file")
+	}
+
+	// A relative path such as "." is stored under the folder's name, so it
+	// cannot clash with another path inside it.
+	workDir := filepath.Join(tempDir, "work")
+	os.MkdirAll(filepath.Join(workDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(workDir, "x.txt"), []byte("top"), 0644)
+	os.WriteFile(filepath.Join(workDir, "sub", "x.txt"), []byte("nested"), 0644)
+	t.Chdir(workDir)
+
+	relative := filepath.Join(tempDir, "relative.cloak")
+	if _, err := EncryptPaths([]string{".", filepath.Join("sub", "x.txt")}, EncryptOptions{Password: password, KDF: fastKDF, Output: relative}); err != nil {
+		t.Fatalf("EncryptPaths with relative paths failed: %v", err)
+	}
+	restoreDir = t.TempDir()
+	if _, err := Decrypt(relative, DecryptOptions{Password: password, Directory: restoreDir}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	for name, want := range map[string]string{"work/x.txt": "top", "work/sub/x.txt": "nested", "x.txt": "nested"} {
+		content, _ := os.ReadFile(filepath.Join(restoreDir, filepath.FromSlash(name)))
+		if string(content) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, content)
+		}
+	}
+}
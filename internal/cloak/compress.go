@@ -0,0 +1,132 @@
+package cloak
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the compressor applied to the tar archive before
+// it is encrypted. Its value is stored in the file header.
+type Compression uint8
+
+// Supported compressors.
+const (
+	// CompressionGzip is the default, and is used by files written before
+	// the compressor was recorded in the header.
+	CompressionGzip Compression = iota
+
+	// CompressionNone stores the tar archive as-is, which suits folders
+	// of already compressed media.
+	CompressionNone
+
+	// CompressionZstd is faster than gzip at a similar ratio.
+	CompressionZstd
+)
+
+// compressionNames holds the name of every compressor, indexed by its value.
+var compressionNames = []string{"gzip", "none", "zstd"}
+
+// Compression level ranges. Level zero selects the default of a compressor.
+const (
+	maxGzipLevel = gzip.BestCompression
+	maxZstdLevel = 22
+)
+
+// ParseCompression returns the compressor with the given name.
+func ParseCompression(name string) (Compression, error) {
+	for i, n := range compressionNames {
+		if n == name {
+			return Compression(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q (available: %s)", name, strings.Join(compressionNames, ", "))
+}
+
+// String returns the name of the compressor.
+func (c Compression) String() string {
+	if c.valid() {
+		return compressionNames[c]
+	}
+	return "Compression(" + strconv.Itoa(int(c)) + ")"
+}
+
+// valid reports whether c is one of the supported compressors.
+func (c Compression) valid() bool {
+	return int(c) < len(compressionNames)
+}
+
+// ValidateLevel checks that level is supported by the compressor. Level
+// zero, the default, is always valid.
+func (c Compression) ValidateLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+	switch c {
+	case CompressionGzip:
+		if level < 1 || level > maxGzipLevel {
+			return fmt.Errorf("gzip level must be between 1 and %d", maxGzipLevel)
+		}
+	case CompressionZstd:
+		if level < 1 || level > maxZstdLevel {
+			return fmt.Errorf("zstd level must be between 1 and %d", maxZstdLevel)
+		}
+	case CompressionNone:
+		return fmt.Errorf("compression %s has no levels", c)
+	default:
+		return fmt.Errorf("unknown compression %s", c)
+	}
+	return nil
+}
+
+// newWriter returns a writer that compresses to w at level. Closing it
+// flushes the compressed data but does not close w.
+func (c Compression) newWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	if err := c.ValidateLevel(level); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// newReader returns a reader that decompresses r.
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %s", c)
+	}
+}
+
+// nopWriteCloser adds a Close method that does nothing to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,76 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, name := range []string{"gzip", "none", "zstd"} {
+		c, err := ParseCompression(name)
+		if err != nil {
+			t.Fatalf("ParseCompression(%q) failed: %v", name, err)
+		}
+		if c.String() != name {
+			t.Errorf("Expected %q, got %q", name, c)
+		}
+	}
+	if _, err := ParseCompression("brotli"); err == nil {
+		t.Error("Expected error for unknown compression")
+	}
+
+	invalid := map[Compression]int{CompressionGzip: 10, CompressionZstd: 23, CompressionNone: 1}
+	for c, level := range invalid {
+		if err := c.ValidateLevel(level); err == nil {
+			t.Errorf("%s: expected error for level %d", c, level)
+		}
+	}
+	if err := CompressionZstd.ValidateLevel(19); err != nil {
+		t.Errorf("zstd level 19 should be valid: %v", err)
+	}
+}
+
+func TestEncryptDecryptCompression(t *testing.T) {
+	content := strings.Repeat("compressible content ", 1000)
+
+	for _, c := range []Compression{CompressionGzip, CompressionNone, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			tempDir := t.TempDir()
+			testDir := filepath.Join(tempDir, "data")
+			os.MkdirAll(testDir, 0755)
+			os.WriteFile(filepath.Join(testDir, "file.txt"), []byte(content), 0644)
+
+			password := writePasswordFile(t, "password")
+			level := 0
+			if c != CompressionNone {
+				level = 1
+			}
+			_, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Compression: c, CompressionLevel: level})
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+			os.RemoveAll(testDir)
+
+			info, err := Inspect(testDir + ".cloak")
+			if err != nil {
+				t.Fatalf("Inspect failed: %v", err)
+			}
+			if info.Compression != c.String() {
+				t.Errorf("Expected compression %s in header, got %s", c, info.Compression)
+			}
+			if uncompressed := info.CiphertextSize > int64(len(content)); uncompressed != (c == CompressionNone) {
+				t.Errorf("Unexpected ciphertext size %d for %s", info.CiphertextSize, c)
+			}
+
+			if _, err := Decrypt(testDir+".cloak", DecryptOptions{Password: password}); err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+			data, _ := os.ReadFile(filepath.Join(testDir, "file.txt"))
+			if string(data) != content {
+				t.Error("Content mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package cloak
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConflictPolicy decides what happens when an archive entry is extracted to
+// a path that already exists.
+type ConflictPolicy uint8
+
+// Conflict policies. Existing directories never conflict; entries are
+// extracted into them.
+const (
+	// ConflictFail stops extraction with an error.
+	ConflictFail ConflictPolicy = iota
+
+	// ConflictSkip keeps the existing file and skips the entry.
+	ConflictSkip
+
+	// ConflictOverwrite replaces the existing file.
+	ConflictOverwrite
+
+	// ConflictRename extracts the entry under a new name, such as
+	// notes.1.txt, and keeps the existing file.
+	ConflictRename
+
+	// ConflictNewer replaces the existing file only if the entry was
+	// modified after it, and skips the entry otherwise.
+	ConflictNewer
+)
+
+// conflictPolicyNames holds the name of every policy, indexed by its value.
+var conflictPolicyNames = []string{"fail", "skip", "overwrite", "rename", "newer"}
+
+// ParseConflictPolicy returns the policy with the given name.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for i, n := range conflictPolicyNames {
+		if n == name {
+			return ConflictPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q (available: %s)", name, strings.Join(conflictPolicyNames, ", "))
+}
+
+// String returns the name of the policy.
+func (p ConflictPolicy) String() string {
+	if int(p) < len(conflictPolicyNames) {
+		return conflictPolicyNames[p]
+	}
+	return "ConflictPolicy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// valid reports whether p is one of the defined policies.
+func (p ConflictPolicy) valid() bool {
+	return int(p) < len(conflictPolicyNames)
+}
+
+// resolveConflict applies the policy to the file or symlink entry header
+// that is about to be extracted to target. It returns the path to extract
+// to, which no longer exists, or "" if the entry should be skipped.
+func (p ConflictPolicy) resolveConflict(target string, header *tar.Header) (string, error) {
+	existing, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch p {
+	case ConflictSkip:
+		return "", nil
+	case ConflictRename:
+		return freePath(target)
+	case ConflictNewer:
+		if !header.ModTime.After(existing.ModTime()) {
+			return "", nil
+		}
+	case ConflictOverwrite:
+	default:
+		return "", fmt.Errorf("refusing to overwrite existing file: %s", target)
+	}
+
+	if existing.IsDir() {
+		return "", fmt.Errorf("cannot replace directory with a file: %s", target)
+	}
+	// Removing the old file, rather than truncating it, keeps a symlink
+	// in its place from redirecting the write.
+	if err := os.Remove(target); err != nil {
+		return "", fmt.Errorf("failed to replace existing file: %w", err)
+	}
+	return target, nil
+}
+
+// freePath returns the first path of the form name.N.ext next to target
+// that does not exist.
+func freePath(target string) (string, error) {
+	dir, name := filepath.Split(target)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		stem, ext = name, ""
+	}
+
+	for n := 1; n < 10000; n++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s.%d%s", stem, n, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find a free name for %s", target)
+}
@@ -0,0 +1,117 @@
+package cloak
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, name := range []string{"fail", "skip", "overwrite", "rename", "newer"} {
+		policy, err := ParseConflictPolicy(name)
+		if err != nil {
+			t.Fatalf("ParseConflictPolicy(%q) failed: %v", name, err)
+		}
+		if policy.String() != name {
+			t.Errorf("Expected %q, got %q", name, policy)
+		}
+	}
+	if _, err := ParseConflictPolicy("merge"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+func TestExtractConflicts(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(srcDir, 0755)
+	os.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("archived"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "new.txt"), []byte("only in archive"), 0644)
+	archived := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(srcDir, "notes.txt"), archived, archived)
+
+	archive, err := ArchiveDirectory(srcDir)
+	if err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+
+	// extract extracts the archive over an existing notes.txt that was
+	// modified at mtime and returns the destination directory.
+	extract := func(policy ConflictPolicy, mtime time.Time) (string, extractResult, error) {
+		destDir := t.TempDir()
+		existing := filepath.Join(destDir, "data", "notes.txt")
+		os.MkdirAll(filepath.Dir(existing), 0755)
+		os.WriteFile(existing, []byte("local"), 0644)
+		os.Chtimes(existing, mtime, mtime)
+
+		result, err := extractArchive(bytes.NewReader(archive), CompressionGzip, destDir, extractOptions{policy: policy})
+		return destDir, result, err
+	}
+	read := func(dir, name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, "data", name))
+		return string(data)
+	}
+
+	if _, _, err := extract(ConflictFail, time.Now()); err == nil {
+		t.Error("ConflictFail should fail on an existing file")
+	}
+
+	dir, result, err := extract(ConflictSkip, time.Now())
+	if err != nil || read(dir, "notes.txt") != "local" || read(dir, "new.txt") != "only in archive" || result.skipped != 1 {
+		t.Errorf("ConflictSkip: %v, %+v", err, result)
+	}
+
+	dir, _, err = extract(ConflictOverwrite, time.Now())
+	if err != nil || read(dir, "notes.txt") != "archived" {
+		t.Errorf("ConflictOverwrite: %v", err)
+	}
+
+	dir, result, err = extract(ConflictRename, time.Now())
+	if err != nil || read(dir, "notes.txt") != "local" || read(dir, "notes.1.txt") != "archived" || result.renamed != 1 {
+		t.Errorf("ConflictRename: %v, %+v", err, result)
+	}
+
+	dir, _, err = extract(ConflictNewer, time.Now())
+	if err != nil || read(dir, "notes.txt") != "local" {
+		t.Errorf("ConflictNewer should keep a newer local file: %v", err)
+	}
+	dir, _, err = extract(ConflictNewer, archived.Add(-time.Hour))
+	if err != nil || read(dir, "notes.txt") != "archived" {
+		t.Errorf("ConflictNewer should replace an older local file: %v", err)
+	}
+}
+
+func TestExtractOverwriteReplacesSymlink(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(srcDir, 0755)
+	os.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("archived"), 0644)
+	archive, _ := ArchiveDirectory(srcDir)
+
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	os.WriteFile(outside, []byte("untouched"), 0644)
+
+	destDir := t.TempDir()
+	os.MkdirAll(filepath.Join(destDir, "data"), 0755)
+	if err := os.Symlink(outside, filepath.Join(destDir, "data", "notes.txt")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	if _, err := extractArchive(bytes.NewReader(archive), CompressionGzip, destDir, extractOptions{policy: ConflictOverwrite}); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "untouched" {
+		t.Error("Overwriting should replace the symlink, not write through it")
+	}
+}
+
+func TestDecryptChecksConflictPolicyFirst(t *testing.T) {
+	encrypted := encryptTestDir(t, EncryptOptions{Password: writePasswordFile(t, "password"), KDF: fastKDF})
+
+	// An unusable password source shows that nothing was unlocked.
+	noPassword := EnvPassword{Name: "CLOAK_TEST_UNSET_VARIABLE"}
+	_, err := Decrypt(encrypted, DecryptOptions{Password: noPassword, OnConflict: ConflictPolicy(99)})
+	if err == nil || err.Error() != "unknown conflict policy ConflictPolicy(99)" {
+		t.Errorf("Expected conflict policy error, got %v", err)
+	}
+}
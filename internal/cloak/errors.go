@@ -0,0 +1,45 @@
+package cloak
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported when a file cannot be decrypted. The returned errors carry
+// more detail; use errors.Is to check for these.
+var (
+	// ErrWrongPassword means that no key slot opens with the given
+	// password, keyfile or identities.
+	ErrWrongPassword = errors.New("invalid password or keyfile")
+
+	// ErrCorrupted means that the file is malformed or failed
+	// authentication after it was unlocked.
+	ErrCorrupted = errors.New("file is corrupted")
+
+	// ErrTruncated means that the file ends before its last chunk.
+	ErrTruncated = errors.New("file is truncated")
+
+	// ErrUnsupportedVersion means that the file, or a part of it, uses a
+	// format version that this version of cloak cannot read.
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+
+	// ErrNotCloakFile means that the file does not start with the magic
+	// bytes of any .cloak format.
+	ErrNotCloakFile = errors.New("not a .cloak file")
+)
+
+// kindError is an error with its own message that matches one of the errors
+// above with errors.Is.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// errorf formats an error message and marks the error as being of kind.
+func errorf(kind error, format string, args ...any) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,376 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Header field tags. Each field is stored as a tag byte, a big-endian uint16
+// length and the field value.
+const (
+	tagChunkSize   = 0x01
+	tagNoncePrefix = 0x02
+	tagSalt        = 0x03
+	tagFactors     = 0x04
+	tagKeySlot     = 0x05
+	tagCompression = 0x06
+	tagStream      = 0x07
+)
+
+// maxHeaderSize bounds the header length accepted when reading a file.
+const maxHeaderSize = 1 << 20
+
+const (
+	// HeaderMACSize is the size of the HMAC-SHA256 that follows the header
+	// fields of a CLOAK03 file.
+	HeaderMACSize = sha256.Size
+
+	// headerMACInfo separates the header MAC key from other keys derived
+	// from the data key.
+	headerMACInfo = "cloak header mac"
+)
+
+// Format versions of chunked files.
+const (
+	// Version2 files do not authenticate their header.
+	Version2 = 2
+
+	// Version3 files pass the header to every chunk as associated data and
+	// end the header with a MAC.
+	Version3 = 3
+
+	// CurrentVersion is the version written by Encrypt.
+	CurrentVersion = Version3
+)
+
+// Header is the plaintext header of a chunked .cloak file.
+//
+// On disk it is the magic bytes, a big-endian uint32 length and a sequence of
+// tagged fields. From version 3 on, a MAC over all of these follows, then the
+// encrypted chunks.
+//
+// Every field except the key slots is passed to each chunk as associated
+// data, so changing it breaks every chunk. Key slots can be rewritten
+// without re-encrypting the payload; they are covered by the header MAC,
+// which is keyed from the data key. The MAC can only be checked once a slot
+// has been opened, so the KDF parameters of a slot are used unauthenticated
+// and are only bounded by KDFParams.Validate.
+type Header struct {
+	// Version is the format version. Zero means CurrentVersion.
+	Version int
+
+	// ChunkSize is the plaintext size of every chunk except the last.
+	ChunkSize uint32
+
+	// NoncePrefix is the random per-file prefix of every chunk nonce.
+	NoncePrefix []byte
+
+	// Compression is the compressor of the archive in the payload. Files
+	// without this field use gzip.
+	Compression Compression
+
+	// Stream marks a file whose payload is a plain byte stream written by
+	// NewEncryptingWriter instead of an archive.
+	Stream bool
+
+	// Slots hold the data key that encrypts the payload, each wrapped
+	// under a different key.
+	Slots []KeySlot
+
+	// Salt is the Argon2id salt of files written before key slots were
+	// introduced, whose payload key is derived directly from the password.
+	Salt []byte
+
+	// Factors lists the key factors needed to derive the key of files
+	// without key slots. Files written without this field only use a
+	// password.
+	Factors uint8
+
+	// raw and mac hold the encoded header and its MAC as read from a file.
+	raw []byte
+	mac []byte
+}
+
+// MarshalBinary encodes the header, including the magic bytes but not the
+// header MAC.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	var fields bytes.Buffer
+	h.writeFields(&fields, true)
+
+	if fields.Len() > maxHeaderSize {
+		return nil, errors.New("header too large")
+	}
+
+	magic := h.magic()
+	buf := make([]byte, 0, len(magic)+4+fields.Len())
+	buf = append(buf, magic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(fields.Len()))
+	buf = append(buf, fields.Bytes()...)
+	return buf, nil
+}
+
+// marshalSealed encodes the header as it is written to a file: for version 3
+// and later, followed by a MAC keyed from dataKey.
+func (h *Header) marshalSealed(dataKey []byte) ([]byte, error) {
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if h.version() < Version3 {
+		return data, nil
+	}
+
+	mac, err := headerMAC(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, mac...), nil
+}
+
+// writeFields appends the tagged fields of the header to buf. Key slots are
+// only included if slots is set.
+func (h *Header) writeFields(buf *bytes.Buffer, slots bool) {
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, h.ChunkSize)
+	writeField(buf, tagChunkSize, chunkSize)
+	writeField(buf, tagNoncePrefix, h.NoncePrefix)
+	if h.Salt != nil {
+		writeField(buf, tagSalt, h.Salt)
+		writeField(buf, tagFactors, []byte{h.Factors})
+	}
+	if h.Compression != CompressionGzip {
+		writeField(buf, tagCompression, []byte{byte(h.Compression)})
+	}
+	if h.Stream {
+		writeField(buf, tagStream, []byte{1})
+	}
+	if slots {
+		for _, slot := range h.Slots {
+			writeField(buf, tagKeySlot, slot.marshal())
+		}
+	}
+}
+
+// associatedData returns the data every chunk is bound to: the magic bytes
+// and every header field except the key slots. Version 2 files use none.
+func (h *Header) associatedData() []byte {
+	if h.version() < Version3 {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(h.magic())
+	h.writeFields(&buf, false)
+	return buf.Bytes()
+}
+
+// verify checks the header MAC of a header read by ReadHeader against the
+// data key. Version 2 headers have no MAC.
+func (h *Header) verify(dataKey []byte) error {
+	if h.version() < Version3 {
+		return nil
+	}
+	mac, err := headerMAC(dataKey, h.raw)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, h.mac) {
+		return errorf(ErrCorrupted, "decryption failed: header has been modified")
+	}
+	return nil
+}
+
+// headerMAC computes the MAC of an encoded header.
+func headerMAC(dataKey, header []byte) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, dataKey, nil, headerMACInfo, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+
+	m := hmac.New(sha256.New, key)
+	m.Write(header)
+	return m.Sum(nil), nil
+}
+
+func (h *Header) version() int {
+	if h.Version == 0 {
+		return CurrentVersion
+	}
+	return h.Version
+}
+
+func (h *Header) magic() string {
+	if h.version() == Version2 {
+		return MagicBytesV2
+	}
+	return MagicBytes
+}
+
+// magicPrefix starts the magic bytes of every format version, which end in
+// a two-digit version number.
+const magicPrefix = "CLOAK"
+
+// formatVersion returns the format version named by the magic bytes at the
+// start of data, which may be shorter than the magic bytes if the file is.
+func formatVersion(data []byte) (int, error) {
+	if len(data) < len(MagicBytes) {
+		if n := min(len(data), len(magicPrefix)); string(data[:n]) == magicPrefix[:n] {
+			return 0, errorf(ErrTruncated, "invalid file: too small to be a valid encrypted file")
+		}
+		return 0, errorf(ErrNotCloakFile, "invalid file: not a .cloak file")
+	}
+
+	magic := string(data[:len(MagicBytes)])
+	switch magic {
+	case MagicBytes:
+		return Version3, nil
+	case MagicBytesV2:
+		return Version2, nil
+	case MagicBytesV1:
+		return 1, nil
+	}
+	if digits := strings.TrimPrefix(magic, magicPrefix); len(digits) == 2 && strings.Trim(digits, "0123456789") == "" {
+		return 0, errorf(ErrUnsupportedVersion, "unsupported file: %s is a newer format than this version of cloak can read", magic)
+	}
+	return 0, errorf(ErrNotCloakFile, "invalid file: not a .cloak file")
+}
+
+// ReadHeader reads and validates a chunked header, including the magic bytes, from r.
+func ReadHeader(r io.Reader) (*Header, error) {
+	prefix := make([]byte, len(MagicBytes)+4)
+	n, err := io.ReadFull(r, prefix)
+	version, versionErr := formatVersion(prefix[:n])
+	switch {
+	case versionErr != nil:
+		return nil, versionErr
+	case version == 1:
+		return nil, errorf(ErrUnsupportedVersion, "unsupported file: CLOAK01 files are not chunked and can only be decrypted to a folder")
+	case err != nil:
+		return nil, errorf(ErrTruncated, "invalid file: too small to be a valid encrypted file")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(MagicBytes):])
+	if size > maxHeaderSize {
+		return nil, errorf(ErrCorrupted, "invalid file: header too large")
+	}
+
+	fields := make([]byte, size)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, errorf(ErrTruncated, "invalid file: header is truncated")
+	}
+
+	h := &Header{Version: version, Factors: FactorPassword}
+	err = parseFields(fields, func(tag byte, value []byte) error {
+		switch tag {
+		case tagChunkSize:
+			if len(value) != 4 {
+				return errorf(ErrCorrupted, "invalid file: malformed chunk size")
+			}
+			h.ChunkSize = binary.BigEndian.Uint32(value)
+		case tagNoncePrefix:
+			h.NoncePrefix = value
+		case tagSalt:
+			h.Salt = value
+		case tagFactors:
+			if len(value) != 1 {
+				return errorf(ErrCorrupted, "invalid file: malformed key factors")
+			}
+			h.Factors = value[0]
+		case tagCompression:
+			if len(value) != 1 || !Compression(value[0]).valid() {
+				return errorf(ErrCorrupted, "invalid file: unsupported compression")
+			}
+			h.Compression = Compression(value[0])
+		case tagStream:
+			if len(value) != 1 || value[0] != 1 {
+				return errorf(ErrCorrupted, "invalid file: malformed payload type")
+			}
+			h.Stream = true
+		case tagKeySlot:
+			slot, err := parseKeySlot(value)
+			if err != nil {
+				return err
+			}
+			h.Slots = append(h.Slots, slot)
+		default:
+			return errorf(ErrCorrupted, "invalid file: unknown header field 0x%02x", tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if h.ChunkSize == 0 || h.ChunkSize > MaxChunkSize {
+		return nil, errorf(ErrCorrupted, "invalid file: unsupported chunk size")
+	}
+	if len(h.NoncePrefix) != noncePrefixSize {
+		return nil, errorf(ErrCorrupted, "invalid file: malformed nonce prefix")
+	}
+
+	if version >= Version3 {
+		mac := make([]byte, HeaderMACSize)
+		if _, err := io.ReadFull(r, mac); err != nil {
+			return nil, errorf(ErrTruncated, "invalid file: header is truncated")
+		}
+		h.raw = append(prefix, fields...)
+		h.mac = mac
+
+		if len(h.Slots) == 0 {
+			return nil, errorf(ErrCorrupted, "invalid file: no key slots")
+		}
+	}
+
+	if len(h.Slots) > 0 {
+		if h.Salt != nil {
+			return nil, errorf(ErrCorrupted, "invalid file: malformed header")
+		}
+		if len(h.Slots) > MaxKeySlots {
+			return nil, errorf(ErrCorrupted, "invalid file: too many key slots")
+		}
+		return h, nil
+	}
+
+	if len(h.Salt) != SaltSize {
+		return nil, errorf(ErrCorrupted, "invalid file: malformed salt")
+	}
+	if h.Factors == 0 || h.Factors&^knownFactors != 0 {
+		return nil, errorf(ErrCorrupted, "invalid file: unsupported key factors")
+	}
+
+	return h, nil
+}
+
+// parseFields calls fn for each tagged field in data.
+func parseFields(data []byte, fn func(tag byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errorf(ErrCorrupted, "invalid file: malformed header")
+		}
+		tag := data[0]
+		n := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+n {
+			return errorf(ErrCorrupted, "invalid file: malformed header")
+		}
+		if err := fn(tag, data[3:3+n]); err != nil {
+			return err
+		}
+		data = data[3+n:]
+	}
+	return nil
+}
+
+// writeField appends a tagged header field to buf.
+func writeField(buf *bytes.Buffer, tag byte, value []byte) {
+	buf.WriteByte(tag)
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(value)))
+	buf.Write(n[:])
+	buf.Write(value)
+}
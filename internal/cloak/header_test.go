@@ -0,0 +1,237 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	salt := make([]byte, SaltSize)
+	rand.Read(salt)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	header := &Header{Version: Version2, ChunkSize: DefaultChunkSize, Salt: salt, NoncePrefix: prefix, Factors: FactorPassword | FactorKeyfile}
+	data, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal header: %v", err)
+	}
+
+	parsed, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+
+	if parsed.ChunkSize != header.ChunkSize {
+		t.Errorf("Chunk size mismatch: got %d", parsed.ChunkSize)
+	}
+	if !bytes.Equal(parsed.Salt, salt) || !bytes.Equal(parsed.NoncePrefix, prefix) {
+		t.Error("Salt or nonce prefix mismatch")
+	}
+	if parsed.Factors != header.Factors {
+		t.Errorf("Factors mismatch: got %d", parsed.Factors)
+	}
+}
+
+func TestReadHeaderRejectsInvalidInput(t *testing.T) {
+	cases := map[string][]byte{
+		"empty":     nil,
+		"v1 magic":  []byte(MagicBytesV1 + "\x00\x00\x00\x00"),
+		"no mac":    []byte(MagicBytes + "\x00\x00\x00\x00"),
+		"truncated": []byte(MagicBytes + "\x00\x00\x00\x10\x01"),
+		"unknown":   []byte(MagicBytes + "\x00\x00\x00\x03\x7f\x00\x00"),
+	}
+
+	for name, data := range cases {
+		if _, err := ReadHeader(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReadHeaderReportsFormatErrors(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want error
+	}{
+		{nil, ErrTruncated},
+		{[]byte("CLO"), ErrTruncated},
+		{[]byte("PK\x03\x04 a zip archive"), ErrNotCloakFile},
+		{[]byte("CLOAKED and then some"), ErrNotCloakFile},
+		{[]byte("CLOAK99\x00\x00\x00\x00"), ErrUnsupportedVersion},
+		{[]byte(MagicBytesV1 + "\x00\x00\x00\x00"), ErrUnsupportedVersion},
+		{[]byte(MagicBytes + "\x00\x00"), ErrTruncated},
+	}
+
+	for _, tc := range cases {
+		if _, err := ReadHeader(bytes.NewReader(tc.data)); !errors.Is(err, tc.want) {
+			t.Errorf("%q: expected %v, got %v", tc.data, tc.want, err)
+		}
+	}
+}
+
+func TestHeaderMAC(t *testing.T) {
+	dataKey, _ := GenerateRandomBytes(KeySize)
+	prefix, _ := GenerateRandomBytes(noncePrefixSize)
+	slot, err := sealPassphraseSlot(dataKey, FactorPassword, []byte("password"), DefaultKDFParams)
+	if err != nil {
+		t.Fatalf("Failed to seal slot: %v", err)
+	}
+
+	header := &Header{ChunkSize: DefaultChunkSize, NoncePrefix: prefix, Slots: []KeySlot{slot}}
+	data, err := header.marshalSealed(dataKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal header: %v", err)
+	}
+
+	parsed, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if err := parsed.verify(dataKey); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+	if !bytes.Equal(parsed.associatedData(), header.associatedData()) {
+		t.Error("Associated data mismatch")
+	}
+
+	otherKey, _ := GenerateRandomBytes(KeySize)
+	if err := parsed.verify(otherKey); err == nil {
+		t.Error("Expected verify to fail with another key")
+	}
+
+	// Flip a bit in every byte of the slot and check the MAC catches it.
+	for i := len(data) - HeaderMACSize - len(slot.marshal()); i < len(data)-HeaderMACSize; i++ {
+		tampered := bytes.Clone(data)
+		tampered[i] ^= 1
+		parsed, err := ReadHeader(bytes.NewReader(tampered))
+		if err != nil {
+			continue
+		}
+		if err := parsed.verify(dataKey); err == nil {
+			t.Fatalf("byte %d: expected verify to fail", i)
+		}
+	}
+}
+
+func TestDecryptDetectsHeaderTampering(t *testing.T) {
+	encrypted := encryptTestDir(t, EncryptOptions{Password: writePasswordFile(t, "password")})
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	// The nonce prefix follows the chunk size field.
+	offset := len(MagicBytes) + 4 + 3 + 4 + 3
+	data[offset] ^= 1
+	os.WriteFile(encrypted, data, 0644)
+
+	_, err = Decrypt(encrypted, DecryptOptions{Password: writePasswordFile(t, "password")})
+	if err == nil {
+		t.Fatal("Expected error for modified header")
+	}
+}
+
+func TestDecryptVersion2(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("version 2"), 0644)
+
+	dataKey, _ := GenerateRandomBytes(KeySize)
+	prefix, _ := GenerateRandomBytes(noncePrefixSize)
+	slot, err := sealPassphraseSlot(dataKey, FactorPassword, []byte("password"), DefaultKDFParams)
+	if err != nil {
+		t.Fatalf("Failed to seal slot: %v", err)
+	}
+
+	header := &Header{Version: Version2, ChunkSize: 64, NoncePrefix: prefix, Slots: []KeySlot{slot}}
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal header: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(headerBytes)
+	w, err := NewStreamWriter(&buf, dataKey, prefix, nil, 64, 1)
+	if err != nil {
+		t.Fatalf("Failed to create stream writer: %v", err)
+	}
+	if err := ArchiveDirectoryTo(w, testDir); err != nil {
+		t.Fatalf("Failed to archive: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	encrypted := filepath.Join(tempDir, "data.cloak")
+	os.WriteFile(encrypted, buf.Bytes(), 0644)
+	os.RemoveAll(testDir)
+
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: writePasswordFile(t, "password")}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(testDir, "file.txt"))
+	if err != nil || string(content) != "version 2" {
+		t.Errorf("Content mismatch: %q, %v", content, err)
+	}
+
+	// Key slot changes keep the version of the file.
+	_, err = AddKeySlot(encrypted, KeyAddOptions{
+		Password:    writePasswordFile(t, "password"),
+		NewPassword: writePasswordFile(t, "second"),
+	})
+	if err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+	os.RemoveAll(testDir)
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: writePasswordFile(t, "second")}); err != nil {
+		t.Fatalf("Decrypt after AddKeySlot failed: %v", err)
+	}
+}
+
+func TestDecryptVersion2WithoutSlots(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("no slots"), 0644)
+
+	salt, _ := GenerateRandomBytes(SaltSize)
+	prefix, _ := GenerateRandomBytes(noncePrefixSize)
+	key := DeriveKey([]byte("password"), salt)
+	defer key.Wipe()
+
+	header := &Header{Version: Version2, ChunkSize: 64, NoncePrefix: prefix, Salt: salt, Factors: FactorPassword}
+	headerBytes, err := header.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal header: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(headerBytes)
+	w, err := NewStreamWriter(&buf, key.Data, prefix, nil, 64, 1)
+	if err != nil {
+		t.Fatalf("Failed to create stream writer: %v", err)
+	}
+	if err := ArchiveDirectoryTo(w, testDir); err != nil {
+		t.Fatalf("Failed to archive: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	encrypted := filepath.Join(tempDir, "data.cloak")
+	os.WriteFile(encrypted, buf.Bytes(), 0644)
+
+	// Nothing checks the key of these files, so a first chunk that fails
+	// to open is taken as a wrong password.
+	if _, err := Verify(encrypted, DecryptOptions{Password: writePasswordFile(t, "wrong")}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+	if _, err := Verify(encrypted, DecryptOptions{Password: writePasswordFile(t, "password")}); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package cloak
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the name of the per-directory file that lists paths to
+// leave out of an archive, in gitignore syntax.
+const IgnoreFileName = ".cloakignore"
+
+// gitIgnoreFileName is read in addition to IgnoreFileName if requested.
+const gitIgnoreFileName = ".gitignore"
+
+// ignoreRule is one line of an ignore file, or one --exclude or --include
+// pattern.
+type ignoreRule struct {
+	// base holds the path elements of the directory the rule applies to,
+	// relative to the archived folder.
+	base []string
+
+	// elems are the pattern elements matched against the path below base.
+	elems []string
+
+	// negate re-includes matching paths.
+	negate bool
+
+	// dirOnly restricts the rule to directories.
+	dirOnly bool
+}
+
+// parseIgnoreRule parses a pattern in gitignore syntax. It returns false for
+// blank lines and comments.
+//
+// A pattern without a slash, other than a trailing one, matches at any depth
+// below base; otherwise it is anchored to base. A trailing slash matches
+// directories only, and a leading ! negates the pattern.
+func parseIgnoreRule(base []string, line string) (ignoreRule, bool, error) {
+	pattern := strings.TrimRight(line, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	elems := strings.FieldsFunc(pattern, func(r rune) bool { return r == '/' })
+	if len(elems) == 0 {
+		return ignoreRule{}, false, fmt.Errorf("invalid pattern %q", line)
+	}
+	for _, elem := range elems {
+		if _, err := path.Match(elem, ""); err != nil {
+			return ignoreRule{}, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	if !strings.Contains(pattern, "/") {
+		elems = append([]string{"**"}, elems...)
+	}
+	rule.elems = elems
+	return rule, true, nil
+}
+
+// match reports whether the path with elements name matches the rule.
+func (r ignoreRule) match(name []string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if len(name) <= len(r.base) {
+		return false
+	}
+	for i, elem := range r.base {
+		if name[i] != elem {
+			return false
+		}
+	}
+	return matchElems(r.elems, name[len(r.base):])
+}
+
+// ignoreFilter decides which paths of a folder are left out of its archive.
+// Rules from ignore files are collected while the folder is walked.
+type ignoreFilter struct {
+	// fileNames are the ignore files read in every directory.
+	fileNames []string
+
+	// rules come from ignore files, parents before children, so that the
+	// last matching rule wins as in git.
+	rules []ignoreRule
+
+	// excludes and includes come from options and override the ignore
+	// files.
+	excludes []ignoreRule
+	includes []ignoreRule
+}
+
+// newIgnoreFilter creates a filter from exclude and include patterns in
+// gitignore syntax. It reads .cloakignore files, and .gitignore files if
+// gitIgnore is set.
+func newIgnoreFilter(excludes, includes []string, gitIgnore bool) (*ignoreFilter, error) {
+	f := &ignoreFilter{fileNames: []string{IgnoreFileName}}
+	if gitIgnore {
+		f.fileNames = append(f.fileNames, gitIgnoreFileName)
+	}
+
+	var err error
+	if f.excludes, err = parseOptionRules(excludes); err != nil {
+		return nil, err
+	}
+	if f.includes, err = parseOptionRules(includes); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseOptionRules parses exclude or include patterns given as options,
+// which apply from the archived folder down and cannot be negated.
+func parseOptionRules(patterns []string) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	for _, pattern := range patterns {
+		rule, ok, err := parseIgnoreRule(nil, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || rule.negate {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// forRoot returns a filter with the same options and no rules from ignore
+// files, for walking another top-level path.
+func (f *ignoreFilter) forRoot() *ignoreFilter {
+	if f == nil {
+		return nil
+	}
+	root := *f
+	root.rules = nil
+	return &root
+}
+
+// readDir adds the rules of the ignore files in dir, whose path relative to
+// the archived folder has the elements base.
+func (f *ignoreFilter) readDir(dir string, base []string) error {
+	for _, name := range f.fileNames {
+		file, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for n := 1; scanner.Scan(); n++ {
+			rule, ok, err := parseIgnoreRule(base, scanner.Text())
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%s line %d: %w", filepath.Join(dir, name), n, err)
+			}
+			if ok {
+				f.rules = append(f.rules, rule)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excluded reports whether the path with elements name, relative to the
+// archived folder, is left out.
+func (f *ignoreFilter) excluded(name []string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+
+	excluded := false
+	for _, rule := range f.rules {
+		if rule.match(name, isDir) {
+			excluded = !rule.negate
+		}
+	}
+	for _, rule := range f.excludes {
+		if rule.match(name, isDir) {
+			excluded = true
+		}
+	}
+	for _, rule := range f.includes {
+		if rule.match(name, isDir) {
+			excluded = false
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,148 @@
+package cloak
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		isDir   bool
+		want    bool
+	}{
+		{"node_modules", "node_modules", true, true},
+		{"node_modules", "web/node_modules", true, true},
+		{"*.log", "logs/debug.log", false, true},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"docs/*.md", "docs/readme.md", false, true},
+		{"docs/*.md", "src/docs/readme.md", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"**/tmp/**", "a/b/tmp/c", false, true},
+		{"*.log", "debug.txt", false, false},
+	}
+
+	for _, tt := range tests {
+		rule, ok, err := parseIgnoreRule(nil, tt.pattern)
+		if err != nil || !ok {
+			t.Fatalf("parseIgnoreRule(%q) failed: %v", tt.pattern, err)
+		}
+		if got := rule.match(splitPath(tt.name), tt.isDir); got != tt.want {
+			t.Errorf("%q matching %q: got %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok, err := parseIgnoreRule(nil, line); ok || err != nil {
+			t.Errorf("%q should be skipped", line)
+		}
+	}
+	if _, _, err := parseIgnoreRule(nil, "[unclosed"); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
+
+// archiveNames archives dir with filter and returns the sorted entry names
+// relative to dir.
+func archiveNames(t *testing.T, dir string, filter *ignoreFilter) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := archivePaths(&buf, []string{dir}, archiveOptions{filter: filter}); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+
+	var names []string
+	err := walkArchive(&buf, CompressionGzip, func(header *tar.Header, _ io.Reader) error {
+		name := filepath.ToSlash(header.Name)
+		if rest, ok := strings.CutPrefix(name, filepath.Base(dir)+"/"); ok {
+			names = append(names, rest)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestArchiveWithIgnoreRules(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "project")
+	files := map[string]string{
+		".cloakignore":            "node_modules/\n*.log\n!keep.log\n",
+		".gitignore":              "dist/\n",
+		"main.go":                 "package main",
+		"debug.log":               "noise",
+		"keep.log":                "kept",
+		"node_modules/pkg/a.js":   "dependency",
+		"dist/app":                "binary",
+		"web/.cloakignore":        "/cache\n",
+		"web/cache/page.html":     "cached",
+		"web/src/cache/notes.txt": "not the web cache",
+		"secrets/token":           "secret",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+	}
+
+	filter, err := newIgnoreFilter([]string{"secrets"}, nil, false)
+	if err != nil {
+		t.Fatalf("newIgnoreFilter failed: %v", err)
+	}
+	got := strings.Join(archiveNames(t, dir, filter), " ")
+	want := ".cloakignore .gitignore dist dist/app keep.log main.go web web/.cloakignore web/src web/src/cache web/src/cache/notes.txt"
+	if got != want {
+		t.Errorf("Unexpected entries:\ngot  %s\nwant %s", got, want)
+	}
+
+	filter, _ = newIgnoreFilter(nil, []string{"debug.log"}, true)
+	got = strings.Join(archiveNames(t, dir, filter), " ")
+	if !strings.Contains(got, "debug.log") || strings.Contains(got, "dist") || !strings.Contains(got, "secrets/token") {
+		t.Errorf("Unexpected entries with --include and .gitignore: %s", got)
+	}
+
+	if _, err := newIgnoreFilter([]string{"!main.go"}, nil, false); err == nil {
+		t.Error("Expected error for a negated exclude pattern")
+	}
+}
+
+func TestEncryptWithExclude(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(filepath.Join(testDir, ".venv"), 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("kept"), 0644)
+	os.WriteFile(filepath.Join(testDir, ".venv", "python"), []byte("left out"), 0644)
+
+	password := writePasswordFile(t, "password")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Exclude: []string{".venv"}}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	var names []string
+	err := List(testDir+".cloak", DecryptOptions{Password: password}, func(e Entry) error {
+		names = append(names, filepath.ToSlash(e.Name))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if strings.Join(names, " ") != "data data/file.txt" {
+		t.Errorf("Unexpected entries: %v", names)
+	}
+
+	_, err = Encrypt(testDir, EncryptOptions{Password: password, Exclude: []string{"[bad"}, Output: filepath.Join(tempDir, "bad.cloak")})
+	if err == nil {
+		t.Error("Expected error for a malformed pattern")
+	}
+}
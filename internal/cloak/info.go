@@ -0,0 +1,171 @@
+package cloak
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// infoCipher is the payload cipher of every format version.
+const infoCipher = "AES-256-GCM"
+
+// Info describes the parts of a .cloak file that can be read without a
+// password.
+type Info struct {
+	// Format is the magic string at the start of the file.
+	Format string `json:"format"`
+
+	// Version is the format version: 1 for CLOAK01 files, otherwise the
+	// version of the chunked format.
+	Version int `json:"version"`
+
+	// Cipher is the cipher that encrypts the payload.
+	Cipher string `json:"cipher"`
+
+	// Payload is "archive" for the files written by Encrypt, or "stream"
+	// for a byte stream written by NewEncryptingWriter.
+	Payload string `json:"payload"`
+
+	// Compression is the compressor of the archive.
+	Compression string `json:"compression"`
+
+	// ChunkSize is the plaintext size of a chunk. It is zero for CLOAK01
+	// files, which are not chunked.
+	ChunkSize uint32 `json:"chunk_size,omitempty"`
+
+	// Chunks is the number of chunks the ciphertext size accounts for.
+	Chunks int64 `json:"chunks,omitempty"`
+
+	// HeaderAuthenticated reports whether the header is protected by a MAC.
+	HeaderAuthenticated bool `json:"header_authenticated"`
+
+	// HeaderSize is the size of the header in bytes, including its MAC.
+	HeaderSize int64 `json:"header_size"`
+
+	// CiphertextSize is the size of the encrypted payload in bytes.
+	CiphertextSize int64 `json:"ciphertext_size"`
+
+	// Slots describe the ways to unlock the file. Files written before key
+	// slots existed are described by a single passphrase slot.
+	Slots []SlotInfo `json:"key_slots"`
+
+	// Recipients is the number of X25519 recipient slots.
+	Recipients int `json:"recipients"`
+}
+
+// SlotInfo describes a key slot.
+type SlotInfo struct {
+	// Type is "passphrase", "x25519" or "unknown".
+	Type string `json:"type"`
+
+	// Factors lists the credentials a passphrase slot needs.
+	Factors []string `json:"factors,omitempty"`
+
+	// KDF holds the Argon2id parameters of a passphrase slot.
+	KDF *KDFParams `json:"argon2id,omitempty"`
+}
+
+// Inspect reads the header of the .cloak file at path and describes it. No
+// password is needed, and nothing is decrypted, so the description is not
+// authenticated.
+func Inspect(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot access file: %w", err)
+	}
+
+	magic := make([]byte, len(MagicBytes))
+	n, _ := io.ReadFull(file, magic)
+	version, err := formatVersion(magic[:n])
+	if err != nil {
+		return nil, err
+	}
+	if version == 1 {
+		return inspectV1(file, stat.Size())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header, err := ReadHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	headerSize, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{
+		Format:              header.magic(),
+		Version:             header.version(),
+		Cipher:              infoCipher,
+		Payload:             "archive",
+		Compression:         header.Compression.String(),
+		ChunkSize:           header.ChunkSize,
+		HeaderAuthenticated: header.version() >= Version3,
+		HeaderSize:          headerSize,
+		CiphertextSize:      stat.Size() - headerSize,
+	}
+
+	if header.Stream {
+		info.Payload = "stream"
+	}
+
+	sealed := int64(header.ChunkSize) + TagSize
+	info.Chunks = (info.CiphertextSize + sealed - 1) / sealed
+
+	if len(header.Slots) == 0 {
+		kdf := DefaultKDFParams
+		info.Slots = []SlotInfo{{Type: "passphrase", Factors: factorNames(header.Factors), KDF: &kdf}}
+		return info, nil
+	}
+
+	for _, slot := range header.Slots {
+		switch slot.Type {
+		case SlotPassphrase:
+			kdf := slot.KDF
+			info.Slots = append(info.Slots, SlotInfo{Type: "passphrase", Factors: factorNames(slot.Factors), KDF: &kdf})
+		case SlotX25519:
+			info.Slots = append(info.Slots, SlotInfo{Type: "x25519"})
+			info.Recipients++
+		default:
+			info.Slots = append(info.Slots, SlotInfo{Type: "unknown"})
+		}
+	}
+	return info, nil
+}
+
+// inspectV1 describes a CLOAK01 file of the given size whose magic bytes
+// have been read from r.
+func inspectV1(r io.Reader, size int64) (*Info, error) {
+	headerSize := int64(len(MagicBytesV1) + SaltSize + NonceSize + 8)
+	fields := make([]byte, headerSize-int64(len(MagicBytesV1)))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, errorf(ErrTruncated, "invalid file: too small to be a valid encrypted file")
+	}
+
+	ciphertextSize := size - headerSize
+	if expected := binary.BigEndian.Uint64(fields[SaltSize+NonceSize:]); uint64(ciphertextSize) < expected {
+		return nil, errorf(ErrTruncated, "invalid file: size mismatch, file is truncated")
+	}
+
+	kdf := DefaultKDFParams
+	return &Info{
+		Format:         MagicBytesV1,
+		Version:        1,
+		Cipher:         infoCipher,
+		Payload:        "archive",
+		Compression:    CompressionGzip.String(),
+		HeaderSize:     headerSize,
+		CiphertextSize: ciphertextSize,
+		Slots:          []SlotInfo{{Type: "passphrase", Factors: []string{"password"}, KDF: &kdf}},
+	}, nil
+}
@@ -0,0 +1,46 @@
+package cloak
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	encrypted := encryptTestDir(t, EncryptOptions{
+		Password:   writePasswordFile(t, "password"),
+		Recipients: []*Recipient{identity.Recipient()},
+		KDF:        fastKDF,
+	})
+
+	info, err := Inspect(encrypted)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Format != MagicBytes || info.Version != CurrentVersion || !info.HeaderAuthenticated {
+		t.Errorf("Unexpected format: %+v", info)
+	}
+	if info.ChunkSize != DefaultChunkSize || info.Chunks != 1 {
+		t.Errorf("Unexpected chunking: %+v", info)
+	}
+
+	stat, _ := os.Stat(encrypted)
+	if info.CiphertextSize != int64(len(payload(t, encrypted))) || info.HeaderSize+info.CiphertextSize != stat.Size() {
+		t.Errorf("Unexpected sizes: header %d, ciphertext %d", info.HeaderSize, info.CiphertextSize)
+	}
+
+	if len(info.Slots) != 2 || info.Recipients != 1 {
+		t.Fatalf("Unexpected slots: %+v", info.Slots)
+	}
+	if info.Slots[0].Type != "passphrase" || *info.Slots[0].KDF != fastKDF || info.Slots[1].Type != "x25519" {
+		t.Errorf("Unexpected slots: %+v", info.Slots)
+	}
+
+	notCloak := filepath.Join(t.TempDir(), "plain.txt")
+	os.WriteFile(notCloak, []byte("just some text, not encrypted"), 0644)
+	if _, err := Inspect(notCloak); !errors.Is(err, ErrNotCloakFile) {
+		t.Errorf("Expected ErrNotCloakFile, got %v", err)
+	}
+}
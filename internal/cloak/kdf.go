@@ -0,0 +1,229 @@
+package cloak
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFArgon2id identifies Argon2id in a key slot. It is the only supported
+// key derivation function.
+const KDFArgon2id uint8 = 1
+
+// Limits on the KDF parameters accepted from a file or an option. The
+// parameters of a key slot are used before the header MAC can be checked, so
+// these bounds are all that limits the work a crafted header can cause.
+const (
+	// MaxKDFMemory is the largest Argon2id memory cost in KiB (1 GiB, the
+	// cost of the paranoid profile).
+	MaxKDFMemory = 1 << 20
+
+	// MaxKDFTime is the largest number of Argon2id iterations.
+	MaxKDFTime = 64
+)
+
+// kdfParamsSize is the encoded size of KDFParams: the KDF id, the time and
+// memory costs as big-endian uint32 values and the number of threads.
+const kdfParamsSize = 10
+
+// KDFParams are the Argon2id parameters used to derive the key of a
+// passphrase slot.
+type KDFParams struct {
+	// Time is the number of iterations.
+	Time uint32 `json:"time"`
+
+	// Memory is the memory cost in KiB.
+	Memory uint32 `json:"memory_kib"`
+
+	// Threads is the degree of parallelism.
+	Threads uint8 `json:"threads"`
+}
+
+// DefaultKDFParams are the parameters used when none are given, and for key
+// slots written before the parameters were stored in the file.
+var DefaultKDFParams = KDFParams{Time: argonTime, Memory: argonMemory, Threads: argonThreads}
+
+// KDFProfiles are named parameter sets for common use cases.
+var KDFProfiles = map[string]KDFParams{
+	"interactive": DefaultKDFParams,
+	"moderate":    {Time: 4, Memory: 256 * 1024, Threads: 4},
+	"paranoid":    {Time: 6, Memory: 1024 * 1024, Threads: 4},
+}
+
+// KDFProfile returns the parameters of the named profile.
+func KDFProfile(name string) (KDFParams, error) {
+	params, ok := KDFProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(KDFProfiles))
+		for n := range KDFProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return KDFParams{}, fmt.Errorf("unknown KDF profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return params, nil
+}
+
+// Validate checks that the parameters are within the supported limits.
+func (p KDFParams) Validate() error {
+	switch {
+	case p.Time == 0 || p.Time > MaxKDFTime:
+		return fmt.Errorf("KDF time must be between 1 and %d", MaxKDFTime)
+	case p.Threads == 0:
+		return errors.New("KDF threads must be at least 1")
+	case p.Memory < 8*uint32(p.Threads) || p.Memory > MaxKDFMemory:
+		return fmt.Errorf("KDF memory must be between %d KiB and %d KiB", 8*uint32(p.Threads), MaxKDFMemory)
+	}
+	return nil
+}
+
+// String returns the parameters in a short human-readable form.
+func (p KDFParams) String() string {
+	return fmt.Sprintf("Argon2id t=%d m=%s p=%d", p.Time, FormatKiB(p.Memory), p.Threads)
+}
+
+// orDefault returns p, or DefaultKDFParams if p is the zero value.
+func (p KDFParams) orDefault() KDFParams {
+	if p == (KDFParams{}) {
+		return DefaultKDFParams
+	}
+	return p
+}
+
+// marshal encodes the parameters together with the KDF id.
+func (p KDFParams) marshal() []byte {
+	buf := make([]byte, 0, kdfParamsSize)
+	buf = append(buf, KDFArgon2id)
+	buf = binary.BigEndian.AppendUint32(buf, p.Time)
+	buf = binary.BigEndian.AppendUint32(buf, p.Memory)
+	return append(buf, p.Threads)
+}
+
+// parseKDFParams decodes and validates parameters read from a file.
+func parseKDFParams(data []byte) (KDFParams, error) {
+	if len(data) != kdfParamsSize {
+		return KDFParams{}, errorf(ErrCorrupted, "invalid file: malformed KDF parameters")
+	}
+	if data[0] != KDFArgon2id {
+		return KDFParams{}, errorf(ErrCorrupted, "invalid file: unsupported KDF %d", data[0])
+	}
+
+	p := KDFParams{
+		Time:    binary.BigEndian.Uint32(data[1:5]),
+		Memory:  binary.BigEndian.Uint32(data[5:9]),
+		Threads: data[9],
+	}
+	if err := p.Validate(); err != nil {
+		return KDFParams{}, errorf(ErrCorrupted, "invalid file: %v", err)
+	}
+	return p, nil
+}
+
+// DeriveKeyWithParams uses Argon2id with the given parameters to derive an
+// encryption key from password and salt.
+func DeriveKeyWithParams(password, salt []byte, p KDFParams) *SecureBytes {
+	key := argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, KeySize)
+	return &SecureBytes{Data: key}
+}
+
+// FormatKiB formats a size in KiB using the largest whole binary unit, such
+// as 64MiB or 1GiB.
+func FormatKiB(kib uint32) string {
+	switch {
+	case kib >= 1<<20 && kib%(1<<20) == 0:
+		return fmt.Sprintf("%dGiB", kib>>20)
+	case kib >= 1<<10 && kib%(1<<10) == 0:
+		return fmt.Sprintf("%dMiB", kib>>10)
+	default:
+		return fmt.Sprintf("%dKiB", kib)
+	}
+}
+
+// minCalibrationMemory is the smallest memory cost in KiB that CalibrateKDF
+// falls back to on slow machines.
+const minCalibrationMemory = 16 * 1024
+
+// CalibrateOptions configures CalibrateKDF.
+type CalibrateOptions struct {
+	// Target is the time one key derivation should take.
+	Target time.Duration
+
+	// MaxMemory is the largest memory cost to use, in KiB.
+	MaxMemory uint32
+
+	// Threads is the degree of parallelism. Zero uses the default.
+	Threads uint8
+
+	// Progress, if set, is called with the result of every measurement.
+	Progress func(params KDFParams, elapsed time.Duration)
+}
+
+// CalibrateKDF benchmarks Argon2id on the current machine and returns the
+// parameters that take close to, but not more than, the target time,
+// together with their measured duration.
+//
+// Memory cost is preferred over iterations: the memory is lowered from
+// MaxMemory only until a single iteration fits the target, and the
+// remaining time is filled with more iterations.
+func CalibrateKDF(opts CalibrateOptions) (KDFParams, time.Duration, error) {
+	if opts.Target <= 0 {
+		return KDFParams{}, 0, errors.New("target time must be positive")
+	}
+	threads := opts.Threads
+	if threads == 0 {
+		threads = DefaultKDFParams.Threads
+	}
+
+	params := KDFParams{Time: 1, Memory: opts.MaxMemory, Threads: threads}
+	if err := params.Validate(); err != nil {
+		return KDFParams{}, 0, err
+	}
+
+	measure := func() time.Duration {
+		elapsed := measureKDF(params)
+		if opts.Progress != nil {
+			opts.Progress(params, elapsed)
+		}
+		return elapsed
+	}
+
+	elapsed := measure()
+	for elapsed > opts.Target && params.Memory/2 >= minCalibrationMemory {
+		params.Memory /= 2
+		elapsed = measure()
+	}
+
+	if elapsed < opts.Target {
+		passes := min(opts.Target/max(elapsed, 1), MaxKDFTime)
+		if passes > 1 {
+			params.Time = uint32(passes)
+			elapsed = measure()
+
+			// Iterations are not quite linear; scale back once if the
+			// estimate overshot.
+			if elapsed > opts.Target && params.Time > 1 {
+				params.Time = max(1, uint32(float64(params.Time)*float64(opts.Target)/float64(elapsed)))
+				elapsed = measure()
+			}
+		}
+	}
+
+	return params, elapsed, nil
+}
+
+// measureKDF returns how long one key derivation with params takes.
+func measureKDF(params KDFParams) time.Duration {
+	password := make([]byte, 16)
+	salt := make([]byte, SaltSize)
+
+	start := time.Now()
+	key := DeriveKeyWithParams(password, salt, params)
+	elapsed := time.Since(start)
+	key.Wipe()
+	return elapsed
+}
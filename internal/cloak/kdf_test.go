@@ -0,0 +1,131 @@
+package cloak
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fastKDF keeps key derivation cheap in tests that do not depend on the
+// default cost.
+var fastKDF = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestKDFProfiles(t *testing.T) {
+	for _, name := range []string{"interactive", "moderate", "paranoid"} {
+		params, err := KDFProfile(name)
+		if err != nil {
+			t.Fatalf("KDFProfile(%q) failed: %v", name, err)
+		}
+		if err := params.Validate(); err != nil {
+			t.Errorf("%s: invalid parameters: %v", name, err)
+		}
+	}
+
+	if params, _ := KDFProfile("interactive"); params != DefaultKDFParams {
+		t.Error("interactive profile should match the defaults")
+	}
+	if _, err := KDFProfile("fast"); err == nil {
+		t.Error("Expected error for unknown profile")
+	}
+}
+
+func TestKDFParamsRoundTrip(t *testing.T) {
+	params := KDFParams{Time: 5, Memory: 128 * 1024, Threads: 2}
+	parsed, err := parseKDFParams(params.marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse parameters: %v", err)
+	}
+	if parsed != params {
+		t.Errorf("Parameters mismatch: got %+v", parsed)
+	}
+
+	invalid := map[string][]byte{
+		"short":       params.marshal()[:9],
+		"unknown kdf": append([]byte{0x7f}, params.marshal()[1:]...),
+		"zero time":   KDFParams{Time: 0, Memory: 1024, Threads: 1}.marshal(),
+		"huge memory": KDFParams{Time: 1, Memory: MaxKDFMemory + 1, Threads: 1}.marshal(),
+		"no threads":  KDFParams{Time: 1, Memory: 1024, Threads: 0}.marshal(),
+	}
+	for name, data := range invalid {
+		if _, err := parseKDFParams(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestKeySlotWithoutKDFUsesDefaults(t *testing.T) {
+	dataKey, _ := GenerateRandomBytes(KeySize)
+	slot, err := sealPassphraseSlot(dataKey, FactorPassword, []byte("password"), DefaultKDFParams)
+	if err != nil {
+		t.Fatalf("Failed to seal slot: %v", err)
+	}
+
+	// Drop the KDF field, as in slots written before it existed.
+	data := slot.marshal()
+	kdfField := append([]byte{slotTagKDF, 0, kdfParamsSize}, slot.KDF.marshal()...)
+	data = bytes.Replace(data, kdfField, nil, 1)
+
+	parsed, err := parseKeySlot(data)
+	if err != nil {
+		t.Fatalf("Failed to parse slot: %v", err)
+	}
+	if parsed.KDF != DefaultKDFParams {
+		t.Errorf("Expected default parameters, got %+v", parsed.KDF)
+	}
+}
+
+func TestEncryptWithKDFParams(t *testing.T) {
+	encrypted := encryptTestDir(t, EncryptOptions{
+		Password: writePasswordFile(t, "password"),
+		KDF:      fastKDF,
+	})
+
+	slots, err := ListKeySlots(encrypted)
+	if err != nil {
+		t.Fatalf("ListKeySlots failed: %v", err)
+	}
+	if slots[0].KDF != fastKDF {
+		t.Errorf("Expected %+v, got %+v", fastKDF, slots[0].KDF)
+	}
+
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: writePasswordFile(t, "password")}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	_, err = Encrypt(t.TempDir(), EncryptOptions{
+		Password: writePasswordFile(t, "password"),
+		KDF:      KDFParams{Time: 1, Memory: 1, Threads: 1},
+	})
+	if err == nil {
+		t.Error("Expected error for invalid KDF parameters")
+	}
+}
+
+func TestCalibrateKDF(t *testing.T) {
+	measurements := 0
+	params, elapsed, err := CalibrateKDF(CalibrateOptions{
+		Target:    50 * time.Millisecond,
+		MaxMemory: 1024,
+		Threads:   1,
+		Progress:  func(KDFParams, time.Duration) { measurements++ },
+	})
+	if err != nil {
+		t.Fatalf("CalibrateKDF failed: %v", err)
+	}
+	if err := params.Validate(); err != nil {
+		t.Errorf("Calibrated parameters are invalid: %v", err)
+	}
+	if params.Memory > 1024 || params.Threads != 1 {
+		t.Errorf("Calibrated parameters exceed the limits: %+v", params)
+	}
+	if elapsed <= 0 || measurements == 0 {
+		t.Error("Expected at least one measurement")
+	}
+
+	if _, _, err := CalibrateKDF(CalibrateOptions{MaxMemory: 1024}); err == nil {
+		t.Error("Expected error without a target")
+	}
+	if _, _, err := CalibrateKDF(CalibrateOptions{Target: time.Second, MaxMemory: 1}); err == nil {
+		t.Error("Expected error for too little memory")
+	}
+}
@@ -0,0 +1,109 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Key factors recorded in the header. A file requires every factor whose
+// bit is set.
+const (
+	// FactorPassword means a password is required.
+	FactorPassword uint8 = 1 << iota
+
+	// FactorKeyfile means a keyfile is required.
+	FactorKeyfile
+
+	knownFactors = FactorPassword | FactorKeyfile
+)
+
+// HashKeyfile returns the SHA-256 hash of the keyfile at path.
+func HashKeyfile(path string) (*SecureBytes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyfile: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	if n == 0 {
+		return nil, errors.New("keyfile is empty")
+	}
+
+	return &SecureBytes{Data: hash.Sum(nil)}, nil
+}
+
+// keyfileSecretLabel starts the composite secret of a slot that requires a
+// keyfile, separating it from any password on its own.
+const keyfileSecretLabel = "cloak keyfile secret v1"
+
+// CompositeSecret combines a password and a keyfile hash into the input for
+// DeriveKey. Either may be nil; with only a password the result is the
+// password itself. With a keyfile hash, the result is a label, the
+// big-endian uint32 length of the password, the password and the hash, so
+// no password can be split differently to give the same input.
+func CompositeSecret(password, keyfileHash []byte) *SecureBytes {
+	if keyfileHash == nil {
+		return &SecureBytes{Data: bytes.Clone(password)}
+	}
+
+	secret := make([]byte, 0, len(keyfileSecretLabel)+4+len(password)+len(keyfileHash))
+	secret = append(secret, keyfileSecretLabel...)
+	secret = binary.BigEndian.AppendUint32(secret, uint32(len(password)))
+	secret = append(secret, password...)
+	secret = append(secret, keyfileHash...)
+	return &SecureBytes{Data: secret}
+}
+
+// selectFactors returns the factors that protect a new passphrase slot: a
+// password unless noPassword is set, and a keyfile if one is given. It
+// returns zero if neither is wanted.
+func selectFactors(noPassword bool, keyfile string) uint8 {
+	var factors uint8
+	if !noPassword {
+		factors |= FactorPassword
+	}
+	if keyfile != "" {
+		factors |= FactorKeyfile
+	}
+	return factors
+}
+
+// readFactors reads the factors listed in factors and returns the combined
+// secret to pass to DeriveKey. The keyfile is read before prompting so a
+// missing keyfile is reported straight away.
+func readFactors(factors uint8, provider PasswordProvider, keyfile, prompt string, confirm bool) (*SecureBytes, error) {
+	var keyfileHash []byte
+	if factors&FactorKeyfile != 0 {
+		if keyfile == "" {
+			return nil, errors.New("this file requires a keyfile")
+		}
+		hash, err := HashKeyfile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		defer hash.Wipe()
+		keyfileHash = hash.Data
+	}
+
+	var password []byte
+	if factors&FactorPassword != 0 {
+		p, err := passwordProvider(provider).Password(prompt, confirm)
+		if err != nil {
+			return nil, err
+		}
+		defer p.Wipe()
+		password = p.Data
+	}
+
+	return CompositeSecret(password, keyfileHash), nil
+}
@@ -0,0 +1,109 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashKeyfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyfile")
+	content := []byte("random keyfile content")
+	os.WriteFile(path, content, 0600)
+
+	hash, err := HashKeyfile(path)
+	if err != nil {
+		t.Fatalf("Failed to hash keyfile: %v", err)
+	}
+	defer hash.Wipe()
+
+	expected := sha256.Sum256(content)
+	if !bytes.Equal(hash.Data, expected[:]) {
+		t.Error("Keyfile hash mismatch")
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, nil, 0600)
+	if _, err := HashKeyfile(empty); err == nil {
+		t.Error("Empty keyfile should be rejected")
+	}
+}
+
+func TestCompositeSecret(t *testing.T) {
+	password := []byte("password")
+	hash := bytes.Repeat([]byte{0xAB}, sha256.Size)
+
+	passwordOnly := CompositeSecret(password, nil)
+	if !bytes.Equal(passwordOnly.Data, password) {
+		t.Error("Password-only secret should equal the password")
+	}
+
+	both := CompositeSecret(password, hash)
+	keyfileOnly := CompositeSecret(nil, hash)
+	if bytes.Equal(both.Data, keyfileOnly.Data) || bytes.Equal(both.Data, passwordOnly.Data) {
+		t.Error("Combined secret should differ from each factor alone")
+	}
+
+	// Moving bytes from the password to the keyfile input must change the
+	// secret.
+	shifted := CompositeSecret(password[:4], append(bytes.Clone(password[4:]), hash...))
+	if bytes.Equal(both.Data, shifted.Data) {
+		t.Error("Combined secret should depend on where the password ends")
+	}
+}
+
+func TestEncryptDecryptWithKeyfile(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("keyfile protected"), 0644)
+
+	keyfile := filepath.Join(tempDir, "usb.key")
+	os.WriteFile(keyfile, []byte("something you have"), 0600)
+	passwordFile := filepath.Join(tempDir, "password")
+	os.WriteFile(passwordFile, []byte("something you know\n"), 0600)
+	password := FilePassword{Path: passwordFile}
+
+	tests := []struct {
+		name string
+		opts EncryptOptions
+	}{
+		{"password and keyfile", EncryptOptions{Password: password, Keyfile: keyfile}},
+		{"keyfile only", EncryptOptions{Keyfile: keyfile, NoPassword: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Encrypt(testDir, tt.opts); err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+
+			restoreDir := t.TempDir()
+			encrypted := filepath.Join(restoreDir, "data.cloak")
+			if err := os.Rename(filepath.Join(tempDir, "data.cloak"), encrypted); err != nil {
+				t.Fatalf("Failed to move encrypted file: %v", err)
+			}
+
+			if _, err := Decrypt(encrypted, DecryptOptions{Password: password}); err == nil {
+				t.Fatal("Decrypt should fail without the keyfile")
+			}
+
+			// The keyfile-only file must not ask for a password, so an
+			// unusable password source is passed.
+			decryptPassword := PasswordProvider(password)
+			if tt.opts.NoPassword {
+				decryptPassword = EnvPassword{Name: "CLOAK_TEST_UNSET_VARIABLE"}
+			}
+			if _, err := Decrypt(encrypted, DecryptOptions{Password: decryptPassword, Keyfile: keyfile}); err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+
+			content, _ := os.ReadFile(filepath.Join(restoreDir, "data", "file.txt"))
+			if string(content) != "keyfile protected" {
+				t.Errorf("Content mismatch: %s", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package cloak
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePasswordFile writes password to a file and returns a provider for it.
+func writePasswordFile(t *testing.T, password string) FilePassword {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+	return FilePassword{Path: path}
+}
+
+// encryptTestDir encrypts a small directory and returns the .cloak path. The
+// directory is removed, so the file can be decrypted in its place.
+func encryptTestDir(t *testing.T, opts EncryptOptions) string {
+	t.Helper()
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("slot protected"), 0644)
+
+	if _, err := Encrypt(testDir, opts); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	os.RemoveAll(testDir)
+	return filepath.Join(tempDir, "data.cloak")
+}
+
+// payload returns the encrypted payload that follows the header of a file.
+func payload(t *testing.T, path string) []byte {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := ReadHeader(file); err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Failed to read payload: %v", err)
+	}
+	return data
+}
+
+func TestKeySlotRoundTrip(t *testing.T) {
+	dataKey, _ := GenerateRandomBytes(KeySize)
+	slot, err := sealPassphraseSlot(dataKey, FactorPassword, []byte("password"), DefaultKDFParams)
+	if err != nil {
+		t.Fatalf("Failed to seal slot: %v", err)
+	}
+
+	parsed, err := parseKeySlot(slot.marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse slot: %v", err)
+	}
+	if parsed.Factors != FactorPassword || !bytes.Equal(parsed.WrappedKey, slot.WrappedKey) {
+		t.Error("Parsed slot doesn't match original")
+	}
+
+	header := &Header{ChunkSize: DefaultChunkSize, NoncePrefix: make([]byte, noncePrefixSize), Slots: []KeySlot{slot}}
+	key, index, err := unlockKey(header, credentials{password: writePasswordFile(t, "password")})
+	if err != nil {
+		t.Fatalf("Failed to unlock: %v", err)
+	}
+	if index != 0 || !bytes.Equal(key.Data, dataKey) {
+		t.Error("Unlocked key doesn't match data key")
+	}
+
+	if _, _, err := unlockKey(header, credentials{password: writePasswordFile(t, "wrong")}); err == nil {
+		t.Error("Unlock should fail with the wrong password")
+	}
+}
+
+func TestAddAndRemoveKeySlot(t *testing.T) {
+	first := writePasswordFile(t, "first-password")
+	second := writePasswordFile(t, "second-password")
+
+	encrypted := encryptTestDir(t, EncryptOptions{Password: first})
+	original := payload(t, encrypted)
+
+	if _, err := AddKeySlot(encrypted, KeyAddOptions{Password: second, NewPassword: second}); err == nil {
+		t.Fatal("AddKeySlot should fail without a valid current password")
+	}
+
+	if _, err := AddKeySlot(encrypted, KeyAddOptions{Password: first, NewPassword: second}); err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+
+	slots, err := ListKeySlots(encrypted)
+	if err != nil {
+		t.Fatalf("ListKeySlots failed: %v", err)
+	}
+	if len(slots) != 2 {
+		t.Fatalf("Expected 2 key slots, got %d", len(slots))
+	}
+	if !bytes.Equal(payload(t, encrypted), original) {
+		t.Error("Adding a key slot should not change the payload")
+	}
+
+	if err := RemoveKeySlot(encrypted, 0, KeyRemoveOptions{Password: second}); err != nil {
+		t.Fatalf("RemoveKeySlot failed: %v", err)
+	}
+	if err := RemoveKeySlot(encrypted, 0, KeyRemoveOptions{Password: second}); err == nil {
+		t.Error("Removing the last key slot should fail")
+	}
+
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: first}); err == nil {
+		t.Error("Removed password should no longer decrypt the file")
+	}
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: second}); err != nil {
+		t.Fatalf("Decrypt with the added password failed: %v", err)
+	}
+
+	content, _ := os.ReadFile(filepath.Join(filepath.Dir(encrypted), "data", "file.txt"))
+	if string(content) != "slot protected" {
+		t.Errorf("Content mismatch: %s", content)
+	}
+}
+
+func TestKeyfileSlotSkipsPasswordPrompt(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "usb.key")
+	os.WriteFile(keyfile, []byte("keyfile"), 0600)
+	password := writePasswordFile(t, "password")
+
+	encrypted := encryptTestDir(t, EncryptOptions{Password: password})
+	_, err := AddKeySlot(encrypted, KeyAddOptions{Password: password, NewKeyfile: keyfile, NewNoPassword: true})
+	if err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+
+	// An unusable password source proves the keyfile slot is tried first.
+	noPassword := EnvPassword{Name: "CLOAK_TEST_UNSET_VARIABLE"}
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: noPassword, Keyfile: keyfile}); err != nil {
+		t.Fatalf("Decrypt with the keyfile slot failed: %v", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "usb.key")
+	os.WriteFile(keyfile, []byte("keyfile"), 0600)
+	old := writePasswordFile(t, "old-password")
+	other := writePasswordFile(t, "other-password")
+	changed := writePasswordFile(t, "new-password")
+
+	encrypted := encryptTestDir(t, EncryptOptions{Password: other})
+	_, err := AddKeySlot(encrypted, KeyAddOptions{Password: other, NewPassword: old, NewKeyfile: keyfile})
+	if err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+	original := payload(t, encrypted)
+
+	if _, err := ChangePassword(encrypted, PasswdOptions{Password: changed, Keyfile: keyfile, NewPassword: changed}); err == nil {
+		t.Fatal("ChangePassword should fail with the wrong current password")
+	}
+
+	_, err = ChangePassword(encrypted, PasswdOptions{Password: old, Keyfile: keyfile, NewPassword: changed, NewKDF: fastKDF})
+	if err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if !bytes.Equal(payload(t, encrypted), original) {
+		t.Error("Changing the password should not change the payload")
+	}
+
+	slots, _ := ListKeySlots(encrypted)
+	if len(slots) != 2 || slots[1].Factors != FactorPassword|FactorKeyfile || slots[1].KDF != fastKDF {
+		t.Fatalf("Unexpected slots after change: %+v", slots)
+	}
+
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: old, Keyfile: keyfile}); err == nil {
+		t.Error("Old password should no longer decrypt the file")
+	}
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: changed, Keyfile: keyfile}); err != nil {
+		t.Fatalf("Decrypt with the new password failed: %v", err)
+	}
+	if _, err := Decrypt(encrypted, DecryptOptions{Password: other, OnConflict: ConflictOverwrite}); err != nil {
+		t.Fatalf("Other slot should be unchanged: %v", err)
+	}
+}
+
+func TestKeyCheckSeparatesDamagedSlot(t *testing.T) {
+	password := writePasswordFile(t, "password")
+	encrypted := encryptTestDir(t, EncryptOptions{Password: password, KDF: fastKDF})
+
+	if _, err := Verify(encrypted, DecryptOptions{Password: writePasswordFile(t, "wrong")}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+
+	slots, err := ListKeySlots(encrypted)
+	if err != nil {
+		t.Fatalf("ListKeySlots failed: %v", err)
+	}
+	if len(slots[0].Check) != KeyCheckSize {
+		t.Fatalf("New slots should have a key check value: %+v", slots[0])
+	}
+
+	// The right password matches the key check value, so a wrapped key
+	// that fails to open means the slot was damaged.
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	data[bytes.Index(data, slots[0].WrappedKey)] ^= 1
+	os.WriteFile(encrypted, data, 0644)
+
+	if _, err := Verify(encrypted, DecryptOptions{Password: password}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	if _, err := Verify(encrypted, DecryptOptions{Password: writePasswordFile(t, "wrong")}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package cloak
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyOptions holds the secrets that protect a file written or read by
+// NewEncryptingWriter, NewDecryptingReader, EncryptDir and DecryptTo. Unlike
+// EncryptOptions and DecryptOptions, it never falls back to a terminal
+// prompt.
+type KeyOptions struct {
+	// Password is the password. When encrypting, an empty password
+	// leaves out the password, so the file is protected by the keyfile or
+	// the recipients alone.
+	Password []byte
+
+	// Keyfile is the path of a keyfile that is required in addition to
+	// the password.
+	Keyfile string
+
+	// Recipients are X25519 public keys that can decrypt a new file with
+	// their identity.
+	Recipients []*Recipient
+
+	// Identities are X25519 secret keys tried against the recipient slots
+	// of a file being decrypted.
+	Identities []*Identity
+
+	// KDF holds the Argon2id parameters of the password slot of a new
+	// file. The zero value uses DefaultKDFParams.
+	KDF KDFParams
+}
+
+// newKey generates the data key and header of a new file protected by k.
+// progress, if set, is told before the key of the password slot is
+// derived.
+func (k KeyOptions) newKey(progress ProgressFunc) (*SecureBytes, *Header, error) {
+	factors := selectFactors(len(k.Password) == 0, k.Keyfile)
+	kdf, err := checkKeys(factors, k.Recipients, k.KDF)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var secret *SecureBytes
+	if factors != 0 {
+		secret, err = readFactors(factors, staticPassword(k.Password), k.Keyfile, "", false)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer secret.Wipe()
+
+		progress.report(ProgressEvent{Phase: PhaseDeriveKey})
+	}
+
+	return newFileKey(factors, secret, k.Recipients, kdf)
+}
+
+// credentials returns k as credentials that never prompt.
+func (k KeyOptions) credentials() credentials {
+	return credentials{
+		password:   staticPassword(k.Password),
+		keyfile:    k.Keyfile,
+		identities: k.Identities,
+	}
+}
+
+// staticPassword is a PasswordProvider that returns a copy of a fixed
+// password.
+type staticPassword []byte
+
+// Password implements PasswordProvider.
+func (p staticPassword) Password(string, bool) (*SecureBytes, error) {
+	if len(p) == 0 {
+		return nil, errors.New("this file requires a password")
+	}
+	return &SecureBytes{Data: bytes.Clone(p)}, nil
+}
+
+// NewEncryptingWriter returns a writer that encrypts the bytes written to it
+// into dst, in the .cloak format. The payload is stored as is, not as an
+// archive, so it can only be read back with NewDecryptingReader. Close must
+// be called to write the final chunk; it does not close dst.
+func NewEncryptingWriter(dst io.Writer, key KeyOptions) (io.WriteCloser, error) {
+	dataKey, header, err := key.newKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer dataKey.Wipe()
+
+	header.Compression = CompressionNone
+	header.Stream = true
+	w, err := newPayloadWriter(dst, dataKey.Data, header, 0)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewDecryptingReader returns a reader of the bytes encrypted into src by
+// NewEncryptingWriter. Data is only returned once it has been
+// authenticated, and the reader returns io.EOF only after the whole stream
+// has been verified. Close must be called to stop the decryption workers;
+// it does not close src.
+func NewDecryptingReader(src io.Reader, key KeyOptions) (io.ReadCloser, error) {
+	header, err := ReadHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Stream {
+		return nil, errors.New("this file holds an archive, not a data stream; extract it with DecryptTo")
+	}
+	stream, err := openStream(src, header, key.credentials(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// EncryptDirOptions configures EncryptDir.
+type EncryptDirOptions struct {
+	// Key holds the password, keyfile and recipients of the new file.
+	Key KeyOptions
+
+	// Exclude and Include select the paths to archive as described for
+	// EncryptOptions. GitIgnore also applies .gitignore files.
+	Exclude   []string
+	Include   []string
+	GitIgnore bool
+
+	// Compression and CompressionLevel select the compressor of the
+	// archive. The zero values use gzip at its default level.
+	Compression      Compression
+	CompressionLevel int
+
+	// Jobs is the number of chunks encrypted in parallel. Zero uses one
+	// worker per CPU.
+	Jobs int
+
+	// Progress, if set, is told when the key is derived and how many
+	// bytes have been archived.
+	Progress ProgressFunc
+}
+
+// EncryptDir archives the folder, or regular file, at src and encrypts it
+// into dst. The result is the same as a .cloak file written by Encrypt and
+// can be read with DecryptTo or the decrypt command. EncryptDir does not
+// close dst.
+func EncryptDir(src string, dst io.Writer, opts EncryptDirOptions) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot access path: %w", err)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("path is not a directory or regular file: %s", src)
+	}
+	absPath, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	if filepath.Base(absPath) == manifestName {
+		return fmt.Errorf("%s cannot be stored under the reserved name %q", src, manifestName)
+	}
+
+	filter, err := newIgnoreFilter(opts.Exclude, opts.Include, opts.GitIgnore)
+	if err != nil {
+		return err
+	}
+	if err := opts.Compression.ValidateLevel(opts.CompressionLevel); err != nil {
+		return err
+	}
+	snapshot, err := newManifest()
+	if err != nil {
+		return err
+	}
+
+	key, header, err := opts.Key.newKey(opts.Progress)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	header.Compression = opts.Compression
+
+	stream, err := newPayloadWriter(dst, key.Data, header, opts.Jobs)
+	if err != nil {
+		return err
+	}
+
+	_, err = archivePaths(stream, []string{src}, archiveOptions{
+		filter:      filter,
+		compression: opts.Compression,
+		level:       opts.CompressionLevel,
+		manifest:    snapshot,
+		progress:    opts.Progress,
+	})
+	if err != nil {
+		stream.Close()
+		return fmt.Errorf("failed to archive: %w", err)
+	}
+	if err := stream.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt data: %w", err)
+	}
+	return nil
+}
+
+// DecryptToOptions configures DecryptTo.
+type DecryptToOptions struct {
+	// Key holds the password, keyfile and identities that unlock the
+	// file.
+	Key KeyOptions
+
+	// Patterns, if set, limits extraction to the matching entries as
+	// described for DecryptOptions.
+	Patterns []string
+
+	// OnConflict decides what happens to entries whose path already
+	// exists. The zero value, ConflictFail, stops with an error.
+	OnConflict ConflictPolicy
+
+	// Jobs is the number of chunks decrypted in parallel. Zero uses one
+	// worker per CPU.
+	Jobs int
+
+	// Progress, if set, is told when the key is derived and how many
+	// bytes of src have been decrypted. The size of src is not known, so
+	// Total is always zero.
+	Progress ProgressFunc
+}
+
+// DecryptTo decrypts a .cloak file read from src and extracts its archive
+// into destDir, which is created if needed. The whole file is authenticated
+// before DecryptTo returns nil; entries extracted before an error is found
+// are left in place. CLOAK01 files are not supported.
+func DecryptTo(src io.Reader, destDir string, opts DecryptToOptions) error {
+	patterns, err := newPatternSet(opts.Patterns)
+	if err != nil {
+		return err
+	}
+	if !opts.OnConflict.valid() {
+		return fmt.Errorf("unknown conflict policy %s", opts.OnConflict)
+	}
+
+	tracker := newProgressTracker(opts.Progress, PhaseDecrypt, 0)
+	src = tracker.count(src)
+
+	header, err := ReadHeader(src)
+	if err != nil {
+		return err
+	}
+	if header.Stream {
+		return errors.New("this file holds a data stream, not an archive; read it with NewDecryptingReader")
+	}
+
+	creds := opts.Key.credentials()
+	creds.progress = opts.Progress
+	stream, err := openStream(src, header, creds, opts.Jobs)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tracker.start()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if _, err := extractArchive(stream, header.Compression, destDir, extractOptions{
+		patterns: patterns,
+		policy:   opts.OnConflict,
+		progress: tracker,
+	}); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+	tracker.setFile("")
+
+	if unmatched := patterns.unmatched(); len(unmatched) > 0 {
+		return fmt.Errorf("no entries match: %s", strings.Join(unmatched, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package cloak
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"time"
+)
+
+// Entry describes a file, directory or symlink stored in an archive.
+type Entry struct {
+	// Name is the slash-separated path of the entry in the archive.
+	Name string
+
+	// Mode holds the permission and type bits of the entry.
+	Mode os.FileMode
+
+	// Size is the size of a regular file in bytes.
+	Size int64
+
+	// ModTime is the modification time recorded in the archive.
+	ModTime time.Time
+
+	// Linkname is the target of a symlink.
+	Linkname string
+}
+
+// newEntry converts a tar header to an Entry.
+func newEntry(header *tar.Header) Entry {
+	return Entry{
+		Name:     header.Name,
+		Mode:     header.FileInfo().Mode(),
+		Size:     header.Size,
+		ModTime:  header.ModTime,
+		Linkname: header.Linkname,
+	}
+}
+
+// List decrypts the .cloak file at path and calls fn for every entry of its
+// archive, in archive order. Nothing is written to disk. The whole file is
+// authenticated before List returns nil.
+func List(path string, opts DecryptOptions, fn func(Entry) error) error {
+	archive, err := openPayload(path, opts)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return walkArchive(archive, archive.compression, func(header *tar.Header, _ io.Reader) error {
+		archive.progress.setFile(header.Name)
+		return fn(newEntry(header))
+	})
+}
@@ -0,0 +1,51 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(filepath.Join(testDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(testDir, "sub", "file.txt"), []byte("listed"), 0640)
+	os.Symlink("sub/file.txt", filepath.Join(testDir, "link"))
+
+	password := writePasswordFile(t, "password")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	os.RemoveAll(testDir)
+
+	entries := map[string]Entry{}
+	err := List(testDir+".cloak", DecryptOptions{Password: password}, func(e Entry) error {
+		entries[e.Name] = e
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != 4 {
+		t.Errorf("Expected 4 entries, got %d: %v", len(entries), entries)
+	}
+	if e := entries["data/sub"]; !e.Mode.IsDir() {
+		t.Errorf("data/sub should be a directory: %v", e.Mode)
+	}
+	if e := entries["data/sub/file.txt"]; e.Size != 6 || e.Mode.Perm() != 0640 {
+		t.Errorf("Unexpected file entry: %+v", e)
+	}
+	if e := entries["data/link"]; e.Mode&os.ModeSymlink == 0 || e.Linkname != "sub/file.txt" {
+		t.Errorf("Unexpected symlink entry: %+v", e)
+	}
+
+	if _, err := os.Stat(testDir); !os.IsNotExist(err) {
+		t.Error("List should not write anything to disk")
+	}
+
+	if err := List(testDir+".cloak", DecryptOptions{Password: writePasswordFile(t, "wrong")}, func(Entry) error { return nil }); err == nil {
+		t.Error("Expected error with the wrong password")
+	}
+}
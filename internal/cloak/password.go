@@ -0,0 +1,210 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// PasswordEnv is the environment variable the password is read from when no
+// other source is given.
+const PasswordEnv = "CLOAK_PASSWORD"
+
+// maxPasswordSize bounds the number of bytes read from a password source.
+const maxPasswordSize = 4096
+
+// PasswordProvider supplies the password used to derive a key.
+type PasswordProvider interface {
+	// Password returns the password. Providers that prompt the user show
+	// prompt and, when confirm is set, ask for the password a second time.
+	// The caller must wipe the returned password.
+	Password(prompt string, confirm bool) (*SecureBytes, error)
+}
+
+// TerminalPassword reads the password from the terminal without echoing.
+type TerminalPassword struct{}
+
+// Password implements PasswordProvider.
+func (TerminalPassword) Password(prompt string, confirm bool) (*SecureBytes, error) {
+	password, err := ReadPasswordSecure(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if !confirm {
+		return password, nil
+	}
+
+	confirmPassword, err := ReadPasswordSecure("Confirm password: ")
+	if err != nil {
+		password.Wipe()
+		return nil, err
+	}
+	defer confirmPassword.Wipe()
+
+	if subtle.ConstantTimeCompare(password.Data, confirmPassword.Data) != 1 {
+		password.Wipe()
+		return nil, errors.New("passwords do not match")
+	}
+
+	return password, nil
+}
+
+// EnvPassword reads the password from an environment variable. The copy
+// held by the process environment cannot be wiped.
+type EnvPassword struct {
+	Name string
+}
+
+// Password implements PasswordProvider.
+func (e EnvPassword) Password(string, bool) (*SecureBytes, error) {
+	value, ok := os.LookupEnv(e.Name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", e.Name)
+	}
+	if value == "" {
+		return nil, errors.New("password cannot be empty")
+	}
+	return &SecureBytes{Data: []byte(value)}, nil
+}
+
+// FilePassword reads the password from the first line of a file.
+type FilePassword struct {
+	Path string
+}
+
+// Password implements PasswordProvider.
+func (f FilePassword) Password(string, bool) (*SecureBytes, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open password file: %w", err)
+	}
+	defer file.Close()
+
+	return readPasswordLine(file)
+}
+
+// FDPassword reads the password from the first line of an open file
+// descriptor, such as a pipe set up by the calling process.
+type FDPassword struct {
+	FD int
+}
+
+// Password implements PasswordProvider.
+func (f FDPassword) Password(string, bool) (*SecureBytes, error) {
+	file := os.NewFile(uintptr(f.FD), fmt.Sprintf("fd%d", f.FD))
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor: %d", f.FD)
+	}
+	defer file.Close()
+
+	return readPasswordLine(file)
+}
+
+// CommandPassword runs a shell command and reads the password from the
+// first line of its standard output.
+type CommandPassword struct {
+	Command string
+}
+
+// Password implements PasswordProvider.
+func (c CommandPassword) Password(string, bool) (*SecureBytes, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", c.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", c.Command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run password command: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run password command: %w", err)
+	}
+
+	password, readErr := readPasswordLine(stdout)
+	io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		if password != nil {
+			password.Wipe()
+		}
+		return nil, fmt.Errorf("password command failed: %w", err)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	return password, nil
+}
+
+// cachedPassword asks p for the password once and returns copies of it
+// afterwards, for operations that unlock several files. Call Wipe when
+// done.
+type cachedPassword struct {
+	p      PasswordProvider
+	secret *SecureBytes
+}
+
+// Password implements PasswordProvider.
+func (c *cachedPassword) Password(prompt string, confirm bool) (*SecureBytes, error) {
+	if c.secret == nil {
+		secret, err := c.p.Password(prompt, confirm)
+		if err != nil {
+			return nil, err
+		}
+		c.secret = secret
+	}
+	return &SecureBytes{Data: bytes.Clone(c.secret.Data)}, nil
+}
+
+// Wipe clears the cached password.
+func (c *cachedPassword) Wipe() {
+	if c.secret != nil {
+		c.secret.Wipe()
+		c.secret = nil
+	}
+}
+
+// readPasswordLine reads the first line of r into a fixed-size buffer that
+// is wiped before returning, so no copies of the password are left behind.
+func readPasswordLine(r io.Reader) (*SecureBytes, error) {
+	buf := make([]byte, maxPasswordSize)
+	defer wipeBytes(buf)
+
+	n := 0
+	for n < len(buf) && bytes.IndexByte(buf[:n], '\n') < 0 {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+	}
+
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	} else if n == len(buf) {
+		return nil, fmt.Errorf("password is longer than %d bytes", maxPasswordSize)
+	}
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	if len(line) == 0 {
+		return nil, errors.New("password cannot be empty")
+	}
+
+	password := make([]byte, len(line))
+	copy(password, line)
+	return &SecureBytes{Data: password}, nil
+}
@@ -0,0 +1,70 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFilePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("file-secret\r\nsecond line\n"), 0600)
+
+	password, err := FilePassword{Path: path}.Password("", false)
+	if err != nil {
+		t.Fatalf("Failed to read password: %v", err)
+	}
+	defer password.Wipe()
+
+	if string(password.Data) != "file-secret" {
+		t.Errorf("Expected first line without line ending, got %q", password.Data)
+	}
+}
+
+func TestFilePasswordRejectsEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(path, []byte("\n"), 0600)
+
+	if _, err := (FilePassword{Path: path}).Password("", false); err == nil {
+		t.Error("Empty password should be rejected")
+	}
+}
+
+func TestEnvPassword(t *testing.T) {
+	t.Setenv("CLOAK_TEST_PASSWORD", "env-secret")
+
+	password, err := EnvPassword{Name: "CLOAK_TEST_PASSWORD"}.Password("", true)
+	if err != nil {
+		t.Fatalf("Failed to read password: %v", err)
+	}
+	defer password.Wipe()
+
+	if string(password.Data) != "env-secret" {
+		t.Errorf("Unexpected password %q", password.Data)
+	}
+
+	if _, err := (EnvPassword{Name: "CLOAK_TEST_UNSET_VARIABLE"}).Password("", false); err == nil {
+		t.Error("Unset variable should be rejected")
+	}
+}
+
+func TestCommandPassword(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+
+	password, err := CommandPassword{Command: "echo command-secret"}.Password("", false)
+	if err != nil {
+		t.Fatalf("Failed to read password: %v", err)
+	}
+	defer password.Wipe()
+
+	if string(password.Data) != "command-secret" {
+		t.Errorf("Unexpected password %q", password.Data)
+	}
+
+	if _, err := (CommandPassword{Command: "echo secret; exit 3"}).Password("", false); err == nil {
+		t.Error("Failing command should be rejected")
+	}
+}
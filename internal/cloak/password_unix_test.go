@@ -0,0 +1,35 @@
+//go:build unix
+
+package cloak
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFDPassword(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	w.Write([]byte("fd-secret\n"))
+	w.Close()
+
+	// FDPassword closes the descriptor it is given, so give it a copy.
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to duplicate descriptor: %v", err)
+	}
+
+	password, err := FDPassword{FD: fd}.Password("", false)
+	if err != nil {
+		t.Fatalf("Failed to read password: %v", err)
+	}
+	defer password.Wipe()
+
+	if string(password.Data) != "fd-secret" {
+		t.Errorf("Unexpected password %q", password.Data)
+	}
+}
@@ -0,0 +1,113 @@
+package cloak
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// patternSet selects archive entries by path patterns and records which
+// patterns have matched.
+//
+// Patterns are slash-separated. Each element is matched with path.Match,
+// and an element of ** matches any number of path elements. A pattern that
+// matches a directory also matches everything below it.
+type patternSet struct {
+	patterns [][]string
+	sources  []string
+	matched  []bool
+}
+
+// newPatternSet parses patterns. It returns nil, which matches every entry,
+// if there are no patterns.
+func newPatternSet(patterns []string) (*patternSet, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	p := &patternSet{sources: patterns, matched: make([]bool, len(patterns))}
+	for _, pattern := range patterns {
+		elems := splitPath(pattern)
+		if len(elems) == 0 {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		for _, elem := range elems {
+			if _, err := path.Match(elem, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+		p.patterns = append(p.patterns, elems)
+	}
+	return p, nil
+}
+
+// match reports whether name, or one of its parent directories, matches any
+// pattern. Every matching pattern is marked as used.
+func (p *patternSet) match(name string) bool {
+	if p == nil {
+		return true
+	}
+
+	elems := splitPath(name)
+	found := false
+	for i, pattern := range p.patterns {
+		for n := 1; n <= len(elems); n++ {
+			if matchElems(pattern, elems[:n]) {
+				p.matched[i] = true
+				found = true
+				break
+			}
+		}
+	}
+	return found
+}
+
+// unmatched returns the patterns that have not matched any entry.
+func (p *patternSet) unmatched() []string {
+	if p == nil {
+		return nil
+	}
+	var list []string
+	for i, ok := range p.matched {
+		if !ok {
+			list = append(list, p.sources[i])
+		}
+	}
+	return list
+}
+
+// matchElems matches path elements against pattern elements.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchElems(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// splitPath splits a slash or backslash separated path into its non-empty
+// elements, dropping "." elements.
+func splitPath(p string) []string {
+	var elems []string
+	for _, elem := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem != "." {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
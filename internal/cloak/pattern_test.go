@@ -0,0 +1,103 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatternSetMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"data/file.txt", "data/file.txt", true},
+		{"data/file.txt", "data/file.txt.bak", false},
+		{"data/docs", "data/docs/guide/intro.md", true},
+		{"data/*.txt", "data/file.txt", true},
+		{"data/*.txt", "data/sub/file.txt", false},
+		{"data/**/*.md", "data/README.md", true},
+		{"data/**/*.md", "data/docs/guide/intro.md", true},
+		{"data/**/*.md", "data/docs/intro.txt", false},
+		{"**/config.yml", "data/app/config.yml", true},
+		{"./data/file.txt", "data/file.txt", true},
+		{"data/", "data", true},
+		{"dat?/[a-f]*", "data/file.txt", true},
+	}
+
+	for _, c := range cases {
+		set, err := newPatternSet([]string{c.pattern})
+		if err != nil {
+			t.Fatalf("%q: %v", c.pattern, err)
+		}
+		if got := set.match(c.name); got != c.want {
+			t.Errorf("%q matching %q: got %v, want %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestPatternSetUnmatched(t *testing.T) {
+	set, err := newPatternSet([]string{"a/*", "b"})
+	if err != nil {
+		t.Fatalf("newPatternSet failed: %v", err)
+	}
+	set.match("a/x")
+	if unmatched := set.unmatched(); len(unmatched) != 1 || unmatched[0] != "b" {
+		t.Errorf("Unexpected unmatched patterns: %v", unmatched)
+	}
+
+	for _, pattern := range []string{"", "/", "data/[a"} {
+		if _, err := newPatternSet([]string{pattern}); err == nil {
+			t.Errorf("%q: expected error", pattern)
+		}
+	}
+
+	var all *patternSet
+	if !all.match("anything") || all.unmatched() != nil {
+		t.Error("A nil pattern set should match everything")
+	}
+}
+
+func TestDecryptPatterns(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(filepath.Join(testDir, "docs", "guide"), 0755)
+	os.WriteFile(filepath.Join(testDir, "config.yml"), []byte("config"), 0644)
+	os.WriteFile(filepath.Join(testDir, "big.bin"), []byte("big"), 0644)
+	os.WriteFile(filepath.Join(testDir, "docs", "guide", "intro.md"), []byte("intro"), 0644)
+	os.WriteFile(filepath.Join(testDir, "docs", "notes.txt"), []byte("notes"), 0644)
+
+	password := writePasswordFile(t, "password")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	os.RemoveAll(testDir)
+
+	_, err := Decrypt(testDir+".cloak", DecryptOptions{
+		Password: password,
+		Patterns: []string{"data/config.yml", "data/docs/**/*.md"},
+	})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	for _, name := range []string{"config.yml", "docs/guide/intro.md"} {
+		if _, err := os.Stat(filepath.Join(testDir, name)); err != nil {
+			t.Errorf("%s should have been extracted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"big.bin", "docs/notes.txt"} {
+		if _, err := os.Stat(filepath.Join(testDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not have been extracted", name)
+		}
+	}
+
+	_, err = Decrypt(testDir+".cloak", DecryptOptions{
+		Password: password,
+		Patterns: []string{"data/config.yml", "data/missing.txt"},
+	})
+	if err == nil {
+		t.Error("Expected error for a pattern that matches nothing")
+	}
+}
@@ -0,0 +1,150 @@
+package cloak
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Phase is a step of an operation reported to a ProgressFunc.
+type Phase int
+
+const (
+	// PhaseDeriveKey derives a key from a password or keyfile with
+	// Argon2id. It reports no byte counts.
+	PhaseDeriveKey Phase = iota + 1
+
+	// PhaseEncrypt archives and encrypts files. Done and Total count the
+	// bytes of the files that are stored.
+	PhaseEncrypt
+
+	// PhaseDecrypt decrypts a .cloak file and reads its archive. Done and
+	// Total count the bytes of the encrypted file.
+	PhaseDecrypt
+)
+
+// String returns a short description of the phase.
+func (p Phase) String() string {
+	switch p {
+	case PhaseDeriveKey:
+		return "deriving key"
+	case PhaseEncrypt:
+		return "encrypting"
+	case PhaseDecrypt:
+		return "decrypting"
+	default:
+		return "unknown"
+	}
+}
+
+// ProgressEvent describes how far an operation has come.
+type ProgressEvent struct {
+	// Phase is the step the operation is in. Every phase starts with an
+	// event whose Done is zero.
+	Phase Phase
+
+	// File is the name of the archive entry being read or written, or
+	// empty between entries.
+	File string
+
+	// Done is the number of bytes processed so far, and Total the number
+	// expected in the phase, or zero if it is not known in advance.
+	Done  int64
+	Total int64
+}
+
+// ProgressFunc receives progress events. It is called often and from the
+// goroutine that runs the operation, so it should return quickly.
+type ProgressFunc func(ProgressEvent)
+
+// report calls fn with e unless fn is nil.
+func (fn ProgressFunc) report(e ProgressEvent) {
+	if fn != nil {
+		fn(e)
+	}
+}
+
+// progressTracker counts the bytes of one phase and reports them. Its
+// methods do nothing on a nil tracker.
+type progressTracker struct {
+	fn    ProgressFunc
+	phase Phase
+	total int64
+	file  string
+
+	// done is updated by count readers, which may run on another
+	// goroutine.
+	done atomic.Int64
+}
+
+// newProgressTracker returns a tracker for phase, or nil if fn is nil.
+// Nothing is reported until start is called.
+func newProgressTracker(fn ProgressFunc, phase Phase, total int64) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+	return &progressTracker{fn: fn, phase: phase, total: total}
+}
+
+// start reports the beginning of the phase.
+func (t *progressTracker) start() {
+	if t != nil {
+		t.fn(ProgressEvent{Phase: t.phase, Total: t.total})
+	}
+}
+
+// setFile reports that the entry name is being processed.
+func (t *progressTracker) setFile(name string) {
+	if t != nil {
+		t.file = name
+		t.report()
+	}
+}
+
+// report sends the current counts.
+func (t *progressTracker) report() {
+	if t != nil {
+		t.fn(ProgressEvent{Phase: t.phase, File: t.file, Done: t.done.Load(), Total: t.total})
+	}
+}
+
+// count returns a reader that adds the bytes read from r to the tracker
+// without reporting them.
+func (t *progressTracker) count(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &countingReader{r: r, t: t}
+}
+
+// watch returns a reader that reports the counts after every read from r.
+// It must be read on the goroutine that runs the operation.
+func (t *progressTracker) watch(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &watchingReader{r: r, t: t}
+}
+
+// countingReader adds the bytes read through it to a tracker.
+type countingReader struct {
+	r io.Reader
+	t *progressTracker
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.t.done.Add(int64(n))
+	return n, err
+}
+
+// watchingReader reports the counts of a tracker after every read.
+type watchingReader struct {
+	r io.Reader
+	t *progressTracker
+}
+
+func (w *watchingReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.t.report()
+	return n, err
+}
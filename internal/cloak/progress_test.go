@@ -0,0 +1,82 @@
+package cloak
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordProgress returns a ProgressFunc that appends every event to events.
+func recordProgress(events *[]ProgressEvent) ProgressFunc {
+	return func(e ProgressEvent) {
+		*events = append(*events, e)
+	}
+}
+
+// phaseEvents returns the events of phase.
+func phaseEvents(events []ProgressEvent, phase Phase) []ProgressEvent {
+	var found []ProgressEvent
+	for _, e := range events {
+		if e.Phase == phase {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestProgress(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+
+	data := make([]byte, DefaultChunkSize+DefaultChunkSize/2)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(testDir, "random.bin"), data, 0644)
+	os.WriteFile(filepath.Join(testDir, "small.txt"), []byte("small"), 0644)
+
+	password := writePasswordFile(t, "password")
+	var events []ProgressEvent
+	result, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Progress: recordProgress(&events)})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if len(events) == 0 || events[0].Phase != PhaseDeriveKey {
+		t.Fatalf("Encrypt should start by deriving the key: %+v", events)
+	}
+	encrypting := phaseEvents(events, PhaseEncrypt)
+	total := int64(len(data) + len("small"))
+	if len(encrypting) < 2 || encrypting[0].Done != 0 || encrypting[0].Total != total {
+		t.Fatalf("Unexpected start of the encrypt phase: %+v", encrypting)
+	}
+	files := make(map[string]bool)
+	for _, e := range encrypting {
+		files[e.File] = true
+	}
+	if !files["data/random.bin"] || !files["data/small.txt"] {
+		t.Errorf("Archived files were not reported: %v", files)
+	}
+	if last := encrypting[len(encrypting)-1]; last.Done != total {
+		t.Errorf("Encrypt ended at %d of %d bytes", last.Done, total)
+	}
+
+	events = nil
+	restoreDir := filepath.Join(tempDir, "restored")
+	if _, err := Decrypt(result.Output, DecryptOptions{Password: password, Directory: restoreDir, Progress: recordProgress(&events)}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	decrypting := phaseEvents(events, PhaseDecrypt)
+	if len(decrypting) < 2 || decrypting[0].Done != 0 || decrypting[0].Total != result.EncryptedSize {
+		t.Fatalf("Unexpected start of the decrypt phase: %+v", decrypting)
+	}
+	for i := 1; i < len(decrypting); i++ {
+		if decrypting[i].Done < decrypting[i-1].Done {
+			t.Fatalf("Progress went backwards: %+v then %+v", decrypting[i-1], decrypting[i])
+		}
+	}
+	if last := decrypting[len(decrypting)-1]; last.Done != last.Total {
+		t.Errorf("Decrypt ended at %d of %d bytes", last.Done, last.Total)
+	}
+}
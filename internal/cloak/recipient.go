@@ -0,0 +1,225 @@
+package cloak
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Encoding prefixes of X25519 keys.
+const (
+	// RecipientPrefix starts the text form of a public key.
+	RecipientPrefix = "cloak1"
+
+	// IdentityPrefix starts the text form of a secret key.
+	IdentityPrefix = "CLOAK-SECRET-KEY-1"
+
+	// x25519Info separates keys derived for recipient slots from other uses
+	// of the shared secret.
+	x25519Info = "cloak x25519 key slot"
+)
+
+// keyEncoding encodes X25519 keys without padding.
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Recipient is an X25519 public key that a data key can be wrapped for.
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// ParseRecipient parses a public key in the form printed by keygen.
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, RecipientPrefix) {
+		return nil, fmt.Errorf("invalid recipient %q: must start with %s", s, RecipientPrefix)
+	}
+
+	data, err := keyEncoding.DecodeString(strings.ToUpper(s[len(RecipientPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+	}
+
+	return &Recipient{key: key}, nil
+}
+
+// String returns the text form of the public key.
+func (r *Recipient) String() string {
+	return RecipientPrefix + strings.ToLower(keyEncoding.EncodeToString(r.key.Bytes()))
+}
+
+// Identity is an X25519 secret key that unwraps data keys sealed for its
+// recipient. The key material is managed by crypto/ecdh and cannot be wiped.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentity parses a secret key in the form written by keygen.
+func ParseIdentity(s string) (*Identity, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, IdentityPrefix) {
+		return nil, errors.New("invalid identity: unknown key format")
+	}
+
+	data, err := keyEncoding.DecodeString(s[len(IdentityPrefix):])
+	if err != nil {
+		return nil, errors.New("invalid identity: malformed key")
+	}
+	defer wipeBytes(data)
+
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, errors.New("invalid identity: malformed key")
+	}
+
+	return &Identity{key: key}, nil
+}
+
+// String returns the text form of the secret key.
+func (i *Identity) String() string {
+	return IdentityPrefix + keyEncoding.EncodeToString(i.key.Bytes())
+}
+
+// Recipient returns the public key of the identity.
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{key: i.key.PublicKey()}
+}
+
+// MarshalText returns the contents of an identity file: comments with the
+// creation time and public key, followed by the secret key.
+func (i *Identity) MarshalText() ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# created: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# public key: %s\n", i.Recipient())
+	fmt.Fprintf(&b, "%s\n", i)
+	return []byte(b.String()), nil
+}
+
+// LoadIdentities reads the identities in an identity file. Blank lines and
+// lines starting with # are ignored.
+func LoadIdentities(path string) ([]*Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open identity file: %w", err)
+	}
+	defer file.Close()
+
+	var identities []*Identity
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		identity, err := ParseIdentity(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read identity file: %w", err)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found in %s", path)
+	}
+
+	return identities, nil
+}
+
+// x25519KEK derives the key that wraps a data key from an X25519 shared
+// secret, bound to both public keys.
+func x25519KEK(shared, ephemeral, recipient []byte) (*SecureBytes, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+
+	kek, err := hkdf.Key(sha256.New, shared, salt, x25519Info, KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureBytes{Data: kek}, nil
+}
+
+// sealRecipientSlot wraps dataKey for the recipient using a fresh ephemeral
+// key pair.
+func sealRecipientSlot(dataKey []byte, r *Recipient) (KeySlot, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeySlot{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	shared, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return KeySlot{}, fmt.Errorf("invalid recipient: %w", err)
+	}
+	defer wipeBytes(shared)
+
+	kek, err := x25519KEK(shared, ephemeral.PublicKey().Bytes(), r.key.Bytes())
+	if err != nil {
+		return KeySlot{}, err
+	}
+	defer kek.Wipe()
+
+	nonce, err := GenerateRandomBytes(NonceSize)
+	if err != nil {
+		return KeySlot{}, err
+	}
+
+	wrapped, err := EncryptData(dataKey, kek.Data, nonce)
+	if err != nil {
+		return KeySlot{}, err
+	}
+
+	return KeySlot{
+		Type:       SlotX25519,
+		Ephemeral:  ephemeral.PublicKey().Bytes(),
+		Nonce:      nonce,
+		WrappedKey: wrapped,
+		Check:      KeyCheck(kek.Data),
+	}, nil
+}
+
+// openRecipientSlot unwraps the data key of a recipient slot with the
+// identity.
+func openRecipientSlot(slot KeySlot, identity *Identity) (*SecureBytes, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(slot.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := identity.key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(shared)
+
+	kek, err := x25519KEK(shared, slot.Ephemeral, identity.key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer kek.Wipe()
+
+	return unwrapKey(slot, kek.Data)
+}
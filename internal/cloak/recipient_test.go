@@ -0,0 +1,140 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecipientRoundTrip(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	parsed, err := ParseIdentity(identity.String())
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	if parsed.String() != identity.String() {
+		t.Error("Identity mismatch after round trip")
+	}
+
+	recipient, err := ParseRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("Failed to parse recipient: %v", err)
+	}
+	if recipient.String() != identity.Recipient().String() {
+		t.Error("Recipient mismatch after round trip")
+	}
+
+	for _, s := range []string{"", "cloak1", "age1abc", identity.String()} {
+		if _, err := ParseRecipient(s); err == nil {
+			t.Errorf("ParseRecipient(%q): expected error", s)
+		}
+	}
+}
+
+func TestLoadIdentities(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	text, _ := identity.MarshalText()
+
+	path := filepath.Join(t.TempDir(), "key.txt")
+	os.WriteFile(path, text, 0600)
+
+	identities, err := LoadIdentities(path)
+	if err != nil {
+		t.Fatalf("LoadIdentities failed: %v", err)
+	}
+	if len(identities) != 1 || identities[0].String() != identity.String() {
+		t.Error("Loaded identity does not match")
+	}
+
+	os.WriteFile(path, []byte("# only a comment\n"), 0600)
+	if _, err := LoadIdentities(path); err == nil {
+		t.Error("Expected error for file without identities")
+	}
+}
+
+func TestEncryptDecryptRecipient(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	other, _ := GenerateIdentity()
+
+	encrypted := encryptTestDir(t, EncryptOptions{
+		NoPassword: true,
+		Recipients: []*Recipient{other.Recipient(), identity.Recipient()},
+	})
+
+	header, err := readKeySlotHeader(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if len(header.Slots) != 2 || header.Slots[0].Type != SlotX25519 {
+		t.Fatalf("Expected two recipient slots, got %+v", header.Slots)
+	}
+
+	// The password provider fails if a password is asked for.
+	_, err = Decrypt(encrypted, DecryptOptions{
+		Password:   EnvPassword{Name: "CLOAK_TEST_UNSET_PASSWORD"},
+		Identities: []*Identity{identity},
+	})
+	if err != nil {
+		t.Fatalf("Decrypt with identity failed: %v", err)
+	}
+
+	stranger, _ := GenerateIdentity()
+	_, err = Decrypt(encrypted, DecryptOptions{Identities: []*Identity{stranger}})
+	if err == nil {
+		t.Error("Expected error for unknown identity")
+	}
+}
+
+func TestEncryptPasswordAndRecipient(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	encrypted := encryptTestDir(t, EncryptOptions{
+		Password:   writePasswordFile(t, "password"),
+		Recipients: []*Recipient{identity.Recipient()},
+	})
+
+	header, err := readKeySlotHeader(encrypted)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+
+	key, index, err := unlockKey(header, credentials{password: writePasswordFile(t, "password")})
+	if err != nil || index != 0 {
+		t.Fatalf("Password unlock failed: index %d, %v", index, err)
+	}
+	passwordKey := string(key.Data)
+
+	key, index, err = unlockKey(header, credentials{identities: []*Identity{identity}})
+	if err != nil || index != 1 {
+		t.Fatalf("Identity unlock failed: index %d, %v", index, err)
+	}
+	if string(key.Data) != passwordKey {
+		t.Error("Slots unwrap different data keys")
+	}
+}
+
+func TestAddRecipientSlot(t *testing.T) {
+	encrypted := encryptTestDir(t, EncryptOptions{Password: writePasswordFile(t, "password")})
+	before := payload(t, encrypted)
+
+	identity, _ := GenerateIdentity()
+	_, err := AddKeySlot(encrypted, KeyAddOptions{
+		Password:     writePasswordFile(t, "password"),
+		NewRecipient: identity.Recipient(),
+	})
+	if err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+
+	if string(payload(t, encrypted)) != string(before) {
+		t.Error("Adding a recipient changed the payload")
+	}
+
+	header, _ := readKeySlotHeader(encrypted)
+	if _, index, err := unlockKey(header, credentials{identities: []*Identity{identity}}); err != nil || index != 1 {
+		t.Errorf("New recipient cannot unlock: index %d, %v", index, err)
+	}
+}
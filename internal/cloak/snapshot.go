@@ -0,0 +1,400 @@
+package cloak
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestName is the name of the tar entry that holds the manifest. It is
+// the first entry of every archive written by Encrypt.
+const manifestName = ".cloak-manifest"
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = 1
+
+// maxManifestSize bounds the size of a manifest, both when it is written
+// and when it is read. It is a variable so tests can lower it.
+var maxManifestSize = 256 << 20
+
+// PAX records of the manifest entry. They repeat the ids of the manifest so
+// that readers which only need those can skip its body.
+const (
+	paxSnapshot = "CLOAK.snapshot"
+	paxParent   = "CLOAK.parent"
+)
+
+// Types of the paths recorded in a manifest.
+const (
+	entryDir     = "dir"
+	entryFile    = "file"
+	entrySymlink = "symlink"
+	entryOther   = "other"
+)
+
+// manifest records every path of a snapshot, including the paths an
+// incremental archive does not store because they did not change.
+type manifest struct {
+	Version int `json:"version"`
+
+	// Snapshot is a random id of the snapshot.
+	Snapshot string `json:"snapshot"`
+
+	// Parent is the id of the snapshot an incremental archive is based
+	// on. It is empty for a full archive.
+	Parent string `json:"parent,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Entries lists the paths of the snapshot in archive order.
+	Entries []manifestEntry `json:"entries"`
+
+	// Deleted lists the paths of the parent snapshot that no longer
+	// exist, or that changed type.
+	Deleted []string `json:"deleted,omitempty"`
+
+	index map[string]*manifestEntry
+}
+
+// manifestEntry describes one path of a snapshot.
+type manifestEntry struct {
+	// Name is the slash-separated path of the entry in the archive.
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Mode     os.FileMode `json:"mode"`
+	Size     int64       `json:"size,omitempty"`
+	ModTime  time.Time   `json:"mtime"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+// newManifest returns an empty manifest with a new snapshot id.
+func newManifest() (*manifest, error) {
+	id, err := GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{
+		Version:  manifestVersion,
+		Snapshot: hex.EncodeToString(id),
+		Created:  time.Now().UTC(),
+	}, nil
+}
+
+// newManifestEntry describes item.
+func newManifestEntry(item archiveItem) manifestEntry {
+	entry := manifestEntry{
+		Name:     filepath.ToSlash(item.name),
+		Mode:     item.info.Mode(),
+		ModTime:  item.info.ModTime().UTC(),
+		Linkname: item.link,
+	}
+	switch {
+	case item.info.IsDir():
+		entry.Type = entryDir
+	case item.info.Mode().IsRegular():
+		entry.Type = entryFile
+		entry.Size = item.info.Size()
+	case item.info.Mode()&os.ModeSymlink != 0:
+		entry.Type = entrySymlink
+	default:
+		entry.Type = entryOther
+	}
+	return entry
+}
+
+// add records item in the manifest.
+func (m *manifest) add(item archiveItem) {
+	m.Entries = append(m.Entries, newManifestEntry(item))
+}
+
+// lookup returns the entry named name, or nil.
+func (m *manifest) lookup(name string) *manifestEntry {
+	if m.index == nil {
+		m.index = make(map[string]*manifestEntry, len(m.Entries))
+		for i := range m.Entries {
+			m.index[m.Entries[i].Name] = &m.Entries[i]
+		}
+	}
+	return m.index[name]
+}
+
+// diff makes m an increment of base: it sets the parent and lists the paths
+// of base that are gone from m. A nil base leaves m a full snapshot.
+func (m *manifest) diff(base *manifest) {
+	if base == nil {
+		return
+	}
+	m.Parent = base.Snapshot
+	for _, old := range base.Entries {
+		if entry := m.lookup(old.Name); entry == nil || entry.Type != old.Type {
+			m.Deleted = append(m.Deleted, old.Name)
+		}
+	}
+}
+
+// unchanged reports whether item is a file or symlink that m records with
+// the same size, modification time, mode and target. Directories are never
+// unchanged, so an increment recreates them all. A nil manifest has no
+// unchanged paths.
+func (m *manifest) unchanged(item archiveItem) bool {
+	if m == nil || item.info.IsDir() {
+		return false
+	}
+	entry := newManifestEntry(item)
+	old := m.lookup(entry.Name)
+	return old != nil && old.Type == entry.Type && old.Type != entryOther &&
+		old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) &&
+		old.Mode == entry.Mode && old.Linkname == entry.Linkname
+}
+
+// marshal encodes the manifest. A manifest larger than maxManifestSize
+// could not be read back, so it is rejected.
+func (m *manifest) marshal() ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("the manifest of %d paths exceeds %d MiB; archive fewer paths at once",
+			len(m.Entries), maxManifestSize>>20)
+	}
+	return data, nil
+}
+
+// write stores the manifest encoded by marshal as an entry of tw.
+func (m *manifest) write(tw *tar.Writer, data []byte) error {
+	records := map[string]string{paxSnapshot: m.Snapshot}
+	if m.Parent != "" {
+		records[paxParent] = m.Parent
+	}
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       manifestName,
+		Mode:       0600,
+		Size:       int64(len(data)),
+		ModTime:    m.Created,
+		PAXRecords: records,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// manifestIDs returns a manifest with only the ids recorded in the tar
+// header of a manifest entry, and no entries.
+func manifestIDs(header *tar.Header) (*manifest, error) {
+	m := &manifest{
+		Version:  manifestVersion,
+		Snapshot: header.PAXRecords[paxSnapshot],
+		Parent:   header.PAXRecords[paxParent],
+		Created:  header.ModTime,
+	}
+	if m.Snapshot == "" {
+		return nil, errorf(ErrCorrupted, "invalid archive: manifest has no snapshot id")
+	}
+	return m, nil
+}
+
+// parseManifest reads a manifest from the body of its tar entry.
+func parseManifest(body io.Reader) (*manifest, error) {
+	data, err := io.ReadAll(io.LimitReader(body, int64(maxManifestSize)+1))
+	if err != nil {
+		return nil, archiveError("failed to read manifest", err)
+	}
+	if len(data) > maxManifestSize {
+		return nil, errorf(ErrCorrupted, "invalid archive: manifest is too large")
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errorf(ErrCorrupted, "invalid archive: malformed manifest: %v", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, errorf(ErrUnsupportedVersion, "unsupported manifest version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// errStopWalk stops walkSnapshot early without an error.
+var errStopWalk = errors.New("stop walk")
+
+// readManifest decrypts the .cloak file at path far enough to read the
+// manifest of its archive. Only key derivation is reported to
+// opts.Progress, since the rest of the file is never read.
+func readManifest(path string, opts DecryptOptions) (*manifest, error) {
+	if progress := opts.Progress; progress != nil {
+		opts.Progress = func(e ProgressEvent) {
+			if e.Phase == PhaseDeriveKey {
+				progress(e)
+			}
+		}
+	}
+
+	archive, err := openPayload(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var m *manifest
+	err = walkSnapshot(archive, archive.compression, true, func(found *manifest) error {
+		m = found
+		return errStopWalk
+	}, func(*tar.Header, io.Reader) error {
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%s has no snapshot manifest; encrypt it again to use it as a base", path)
+	}
+	return m, nil
+}
+
+// RestoreResult summarizes what Restore did.
+type RestoreResult struct {
+	// Directory is the absolute path of the directory restored into.
+	Directory string
+
+	// Archives is the number of archives applied.
+	Archives int
+
+	// Deleted is the number of paths removed because an increment
+	// recorded them as deleted.
+	Deleted int
+}
+
+// Restore decrypts a full archive followed by a chain of incremental
+// archives, each created with EncryptOptions.Since set to the one before
+// it, and extracts the resulting snapshot. Paths deleted by an increment
+// are removed, and the files it stores replace the ones extracted before.
+//
+// The first archive is extracted according to opts.OnConflict. Patterns
+// are not supported, since deletions apply to whole paths. Every archive
+// reports its own PhaseDecrypt to opts.Progress.
+func Restore(paths []string, opts DecryptOptions) (RestoreResult, error) {
+	if len(paths) == 0 {
+		return RestoreResult{}, errors.New("no archives to restore")
+	}
+	if len(opts.Patterns) > 0 {
+		return RestoreResult{}, errors.New("patterns cannot be used when restoring a snapshot chain")
+	}
+	if !opts.OnConflict.valid() {
+		return RestoreResult{}, fmt.Errorf("unknown conflict policy %s", opts.OnConflict)
+	}
+
+	outputDir := opts.Directory
+	if outputDir == "" {
+		outputDir = filepath.Dir(paths[0])
+	}
+	outputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return RestoreResult{}, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Every archive of a chain is usually protected by the same password,
+	// so it is asked for only once.
+	password := &cachedPassword{p: passwordProvider(opts.Password)}
+	defer password.Wipe()
+	opts.Password = password
+
+	result := RestoreResult{Directory: outputDir}
+	var previous *manifest
+	for i, path := range paths {
+		m, err := restoreArchive(path, opts, outputDir, previous, i == 0)
+		if err != nil {
+			return RestoreResult{}, err
+		}
+		if m != nil {
+			result.Deleted += len(m.Deleted)
+		}
+		previous = m
+		opts.OnConflict = ConflictOverwrite
+	}
+
+	result.Archives = len(paths)
+	return result, nil
+}
+
+// restoreArchive extracts one archive of a chain to outputDir. An increment
+// must be based on previous, whose deletions are applied before its entries
+// are extracted. It returns the manifest of the archive.
+func restoreArchive(path string, opts DecryptOptions, outputDir string, previous *manifest, first bool) (*manifest, error) {
+	archive, err := openPayload(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var current *manifest
+	_, err = extractArchive(archive, archive.compression, outputDir, extractOptions{
+		policy:          opts.OnConflict,
+		manifestEntries: true,
+		onManifest: func(m *manifest) error {
+			switch {
+			case first && m != nil && m.Parent != "":
+				return fmt.Errorf("%s is an incremental archive; restore its base first", path)
+			case first:
+			case m == nil:
+				return fmt.Errorf("%s has no snapshot manifest and cannot be applied as an increment", path)
+			case previous == nil || m.Parent != previous.Snapshot:
+				return fmt.Errorf("%s is not an increment of the archive before it", path)
+			}
+			current = m
+			if m == nil {
+				return nil
+			}
+			return applyDeletions(outputDir, m.Deleted)
+		},
+		progress: archive.progress,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract archive: %w", err)
+	}
+	archive.progress.setFile("")
+	return current, nil
+}
+
+// applyDeletions removes the paths an increment recorded as deleted. A
+// name that refers to destDir itself is rejected, as removing it would
+// delete everything restored so far.
+func applyDeletions(destDir string, names []string) error {
+	for _, name := range names {
+		target, err := archiveTarget(destDir, name)
+		if err != nil {
+			return err
+		}
+		if target == filepath.Clean(destDir) {
+			return fmt.Errorf("invalid deleted path in manifest: %q", name)
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to remove deleted path: %w", err)
+		}
+	}
+	return nil
+}
+
+// archiveTarget returns the path below destDir that the archive entry name
+// is extracted to. Names that would leave destDir are rejected.
+func archiveTarget(destDir, name string) (string, error) {
+	cleanName := filepath.Clean(filepath.FromSlash(name))
+	if strings.HasPrefix(cleanName, "..") || filepath.IsAbs(cleanName) {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+	return filepath.Join(destDir, cleanName), nil
+}
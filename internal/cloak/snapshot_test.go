@@ -0,0 +1,155 @@
+package cloak
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIncrementalRestore(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(filepath.Join(testDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(testDir, "keep.txt"), []byte("unchanged"), 0644)
+	os.WriteFile(filepath.Join(testDir, "change.txt"), []byte("before"), 0644)
+	os.WriteFile(filepath.Join(testDir, "gone.txt"), []byte("deleted later"), 0644)
+	os.WriteFile(filepath.Join(testDir, "sub", "old.txt"), []byte("old"), 0644)
+
+	password := writePasswordFile(t, "password")
+	full := filepath.Join(tempDir, "full.cloak")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: full}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	os.WriteFile(filepath.Join(testDir, "change.txt"), []byte("after"), 0644)
+	os.Chtimes(filepath.Join(testDir, "change.txt"), later, later)
+	os.WriteFile(filepath.Join(testDir, "new.txt"), []byte("added"), 0644)
+	os.Remove(filepath.Join(testDir, "gone.txt"))
+	os.RemoveAll(filepath.Join(testDir, "sub"))
+
+	increment := filepath.Join(tempDir, "inc.cloak")
+	_, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: increment, Since: full})
+	if err != nil {
+		t.Fatalf("Encrypt with Since failed: %v", err)
+	}
+
+	var names []string
+	err = List(increment, DecryptOptions{Password: password}, func(e Entry) error {
+		names = append(names, e.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	sort.Strings(names)
+	want := []string{"data", "data/change.txt", "data/new.txt"}
+	if len(names) != len(want) {
+		t.Fatalf("Increment stores %v, expected %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("Increment stores %v, expected %v", names, want)
+		}
+	}
+
+	for path, incremental := range map[string]bool{full: false, increment: true} {
+		result, err := Decrypt(path, DecryptOptions{Password: password, Directory: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Decrypt %s failed: %v", path, err)
+		}
+		if result.Incremental != incremental {
+			t.Errorf("%s: Incremental is %v, expected %v", path, result.Incremental, incremental)
+		}
+	}
+
+	restoreDir := filepath.Join(tempDir, "restored")
+	if _, err := Restore([]string{full, increment}, DecryptOptions{Password: password, Directory: restoreDir}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for name, content := range map[string]string{"keep.txt": "unchanged", "change.txt": "after", "new.txt": "added"} {
+		data, err := os.ReadFile(filepath.Join(restoreDir, "data", name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: got %q, %v; expected %q", name, data, err, content)
+		}
+	}
+	for _, name := range []string{"gone.txt", "sub"} {
+		if _, err := os.Lstat(filepath.Join(restoreDir, "data", name)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", name)
+		}
+	}
+}
+
+func TestRestoreRejectsBrokenChain(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("content"), 0644)
+
+	password := writePasswordFile(t, "password")
+	full := filepath.Join(tempDir, "full.cloak")
+	other := filepath.Join(tempDir, "other.cloak")
+	increment := filepath.Join(tempDir, "inc.cloak")
+	for _, opts := range []EncryptOptions{
+		{Output: full},
+		{Output: other},
+		{Output: increment, Since: full},
+	} {
+		opts.Password = password
+		opts.KDF = fastKDF
+		if _, err := Encrypt(testDir, opts); err != nil {
+			t.Fatalf("Encrypt %s failed: %v", opts.Output, err)
+		}
+	}
+
+	for name, chain := range map[string][]string{
+		"increment first": {increment},
+		"wrong base":      {other, increment},
+		"full as step":    {full, other},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(tempDir, name)
+			if _, err := Restore(chain, DecryptOptions{Password: password, Directory: dir}); err == nil {
+				t.Error("Expected Restore to fail")
+			}
+		})
+	}
+}
+
+func TestApplyDeletionsRejectsDestination(t *testing.T) {
+	destDir := t.TempDir()
+	os.WriteFile(filepath.Join(destDir, "restored.txt"), []byte("restored"), 0644)
+
+	for _, name := range []string{".", "", "./", "data/..", "../" + filepath.Base(destDir)} {
+		if err := applyDeletions(destDir, []string{name}); err == nil {
+			t.Errorf("Deleting %q should be rejected", name)
+		}
+		if _, err := os.Stat(filepath.Join(destDir, "restored.txt")); err != nil {
+			t.Fatalf("Deleting %q removed the restored files: %v", name, err)
+		}
+	}
+}
+
+func TestManifestTooLarge(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		os.WriteFile(filepath.Join(testDir, name), []byte(name), 0644)
+	}
+
+	defer func(size int) { maxManifestSize = size }(maxManifestSize)
+	maxManifestSize = 256
+
+	output := filepath.Join(tempDir, "data.cloak")
+	password := writePasswordFile(t, "password")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF, Output: output}); err == nil {
+		t.Fatal("Expected an error for a manifest that could not be read back")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("No output file should be left behind, got %v", err)
+	}
+}
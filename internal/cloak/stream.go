@@ -0,0 +1,508 @@
+package cloak
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// The payload of a chunked .cloak file is split into chunks of ChunkSize
+// plaintext bytes that are sealed individually with AES-256-GCM. Each chunk
+// nonce is the per-file nonce prefix, a big-endian chunk counter and a final
+// flag byte, so chunks cannot be reordered or dropped, and a file cut at a
+// chunk boundary fails to authenticate.
+const (
+	// DefaultChunkSize is the plaintext size of each chunk (1 MiB).
+	DefaultChunkSize = 1 << 20
+
+	// MaxChunkSize is the largest chunk size accepted when reading a file.
+	MaxChunkSize = 16 << 20
+
+	// TagSize is the size of the AES-GCM authentication tag on each chunk.
+	TagSize = 16
+
+	// noncePrefixSize is the size of the random per-file nonce prefix.
+	noncePrefixSize = NonceSize - 5
+)
+
+// chunkNonce builds the nonce for the chunk at the given position.
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[NonceSize-1] = 1
+	}
+	return nonce
+}
+
+// newGCM creates an AES-256-GCM AEAD for the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return gcm, nil
+}
+
+// DefaultJobs returns the default number of chunks processed in parallel.
+func DefaultJobs() int {
+	return runtime.NumCPU()
+}
+
+// chunk is a unit of work passed through the parallel pipeline. Chunks are
+// queued in order and processed by a pool of workers; done is closed once the
+// worker has filled in out or err.
+type chunk struct {
+	counter uint32
+	final   bool
+	in      []byte
+	out     []byte
+	err     error
+	done    chan struct{}
+}
+
+// wipe clears both buffers of the chunk.
+func (c *chunk) wipe() {
+	wipeBytes(c.in[:cap(c.in)])
+	wipeBytes(c.out[:cap(c.out)])
+}
+
+// chunkPool recycles chunk buffers so the pipeline allocates a bounded
+// number of them.
+type chunkPool struct {
+	free    chan *chunk
+	inSize  int
+	outSize int
+}
+
+func newChunkPool(size, inSize, outSize int) *chunkPool {
+	return &chunkPool{free: make(chan *chunk, size), inSize: inSize, outSize: outSize}
+}
+
+func (p *chunkPool) get() *chunk {
+	select {
+	case c := <-p.free:
+		c.in, c.out, c.err = c.in[:0], c.out[:0], nil
+		c.done = make(chan struct{})
+		return c
+	default:
+		return &chunk{
+			in:   make([]byte, 0, p.inSize),
+			out:  make([]byte, 0, p.outSize),
+			done: make(chan struct{}),
+		}
+	}
+}
+
+func (p *chunkPool) put(c *chunk) {
+	c.wipe()
+	select {
+	case p.free <- c:
+	default:
+	}
+}
+
+// normalizeJobs returns the worker count to use for the requested jobs.
+func normalizeJobs(jobs int) int {
+	if jobs <= 0 {
+		return DefaultJobs()
+	}
+	return jobs
+}
+
+// StreamWriter encrypts data written to it as a sequence of chunks, sealing
+// up to jobs chunks in parallel while writing them to dst in order.
+// Close must be called to write the final chunk.
+type StreamWriter struct {
+	prefix    []byte
+	ad        []byte
+	chunkSize int
+	cur       *chunk
+	counter   uint32
+	pool      *chunkPool
+	work      chan *chunk
+	order     chan *chunk
+	written   chan struct{}
+	workers   sync.WaitGroup
+	closed    bool
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewStreamWriter returns a StreamWriter that writes encrypted chunks to dst
+// using jobs workers. Every chunk is bound to the associated data ad, which
+// may be nil. A jobs value of zero uses one worker per CPU.
+func NewStreamWriter(dst io.Writer, key, noncePrefix, ad []byte, chunkSize, jobs int) (*StreamWriter, error) {
+	if len(noncePrefix) != noncePrefixSize {
+		return nil, errors.New("invalid nonce prefix size")
+	}
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, errors.New("invalid chunk size")
+	}
+	jobs = normalizeJobs(jobs)
+
+	aeads := make([]cipher.AEAD, jobs)
+	for i := range aeads {
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i] = aead
+	}
+
+	w := &StreamWriter{
+		prefix:    noncePrefix,
+		ad:        ad,
+		chunkSize: chunkSize,
+		pool:      newChunkPool(2*jobs+2, chunkSize, chunkSize+TagSize),
+		work:      make(chan *chunk, jobs),
+		order:     make(chan *chunk, 2*jobs),
+		written:   make(chan struct{}),
+	}
+	w.cur = w.pool.get()
+
+	for _, aead := range aeads {
+		w.workers.Add(1)
+		go w.seal(aead)
+	}
+	go w.writeLoop(dst)
+
+	return w, nil
+}
+
+// Write buffers p and queues every chunk that is known not to be the last.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, because the
+		// last chunk has to carry the final flag.
+		if len(w.cur.in) == w.chunkSize {
+			if err := w.submit(false); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(w.cur.in[len(w.cur.in):w.chunkSize], p)
+		w.cur.in = w.cur.in[:len(w.cur.in)+m]
+		p = p[m:]
+		n += m
+	}
+
+	return n, nil
+}
+
+// Close seals the buffered data as the final chunk, waits for every chunk
+// to be written and wipes the buffers.
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return w.failed()
+	}
+	w.closed = true
+
+	err := w.submit(true)
+	close(w.work)
+	close(w.order)
+	<-w.written
+	w.workers.Wait()
+
+	if err == nil {
+		err = w.failed()
+	}
+	return err
+}
+
+// submit queues the current chunk for sealing.
+func (w *StreamWriter) submit(final bool) error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+	if !final && w.counter == math.MaxUint32 {
+		return errors.New("stream too large")
+	}
+
+	c := w.cur
+	c.counter, c.final = w.counter, final
+	w.order <- c
+	w.work <- c
+
+	w.counter++
+	w.cur = w.pool.get()
+	return nil
+}
+
+// seal encrypts queued chunks until the work queue is closed.
+func (w *StreamWriter) seal(aead cipher.AEAD) {
+	defer w.workers.Done()
+	for c := range w.work {
+		c.out = aead.Seal(c.out[:0], chunkNonce(w.prefix, c.counter, c.final), c.in, w.ad)
+		close(c.done)
+	}
+}
+
+// writeLoop writes sealed chunks to dst in the order they were queued.
+func (w *StreamWriter) writeLoop(dst io.Writer) {
+	defer close(w.written)
+	for c := range w.order {
+		<-c.done
+		if w.failed() == nil {
+			if _, err := dst.Write(c.out); err != nil {
+				w.fail(err)
+			}
+		}
+		w.pool.put(c)
+	}
+}
+
+func (w *StreamWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *StreamWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// StreamReader decrypts and authenticates a sequence of chunks, opening up
+// to jobs chunks in parallel. Data is only returned after the chunk holding
+// it has been authenticated.
+type StreamReader struct {
+	src       *bufio.Reader
+	prefix    []byte
+	ad        []byte
+	chunkSize int
+	pool      *chunkPool
+	work      chan *chunk
+	order     chan *chunk
+	quit      chan struct{}
+	cur       *chunk
+	pos       int
+	err       error
+	closed    bool
+
+	// uncheckedKey is set for files whose key cannot be checked before
+	// the payload is read. A first chunk that fails to open is then most
+	// likely due to a wrong password.
+	uncheckedKey bool
+}
+
+// NewStreamReader returns a StreamReader that reads encrypted chunks from src
+// using jobs workers. The chunks must have been sealed with the same
+// associated data ad. A jobs value of zero uses one worker per CPU.
+// Close must be called to stop the workers.
+func NewStreamReader(src io.Reader, key, noncePrefix, ad []byte, chunkSize, jobs int) (*StreamReader, error) {
+	if len(noncePrefix) != noncePrefixSize {
+		return nil, errors.New("invalid nonce prefix size")
+	}
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, errors.New("invalid chunk size")
+	}
+	jobs = normalizeJobs(jobs)
+
+	aeads := make([]cipher.AEAD, jobs)
+	for i := range aeads {
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads[i] = aead
+	}
+
+	r := &StreamReader{
+		src:       bufio.NewReader(src),
+		prefix:    noncePrefix,
+		ad:        ad,
+		chunkSize: chunkSize,
+		pool:      newChunkPool(2*jobs+2, chunkSize+TagSize, chunkSize),
+		work:      make(chan *chunk, jobs),
+		order:     make(chan *chunk, 2*jobs),
+		quit:      make(chan struct{}),
+	}
+
+	for _, aead := range aeads {
+		go r.open(aead)
+	}
+	go r.readLoop()
+
+	return r, nil
+}
+
+// Read reads decrypted data. It returns io.EOF only after the final chunk has
+// been authenticated.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for r.cur == nil || r.pos == len(r.cur.out) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.cur != nil {
+			final := r.cur.final
+			r.pool.put(r.cur)
+			r.cur = nil
+			if final {
+				r.err = io.EOF
+				continue
+			}
+		}
+
+		c, ok := <-r.order
+		if !ok {
+			r.err = errors.New("read from closed stream")
+			continue
+		}
+		<-c.done
+		if c.err != nil {
+			r.err = c.err
+			if r.uncheckedKey && c.counter == 0 && errors.Is(c.err, ErrCorrupted) {
+				r.err = errorf(ErrWrongPassword, "decryption failed: invalid password or corrupted file")
+			}
+			r.pool.put(c)
+			continue
+		}
+		r.cur, r.pos = c, 0
+	}
+
+	n := copy(p, r.cur.out[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// Close stops the workers and wipes the decrypted data held by the reader.
+func (r *StreamReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	close(r.quit)
+	for c := range r.order {
+		<-c.done
+		c.wipe()
+	}
+	if r.cur != nil {
+		r.cur.wipe()
+		r.cur = nil
+	}
+	return nil
+}
+
+// readLoop reads encrypted chunks from src and queues them in order.
+func (r *StreamReader) readLoop() {
+	defer close(r.order)
+	defer close(r.work)
+
+	for counter := uint32(0); ; counter++ {
+		c := r.pool.get()
+		c.counter = counter
+		c.err = r.readChunk(c)
+
+		if c.err == nil && !c.final && counter == math.MaxUint32 {
+			c.err = errorf(ErrCorrupted, "decryption failed: stream too large")
+		}
+
+		select {
+		case r.order <- c:
+		case <-r.quit:
+			return
+		}
+
+		if c.err != nil {
+			close(c.done)
+			return
+		}
+
+		select {
+		case r.work <- c:
+		case <-r.quit:
+			close(c.done)
+			return
+		}
+
+		if c.final {
+			return
+		}
+	}
+}
+
+// readChunk reads the next encrypted chunk into c and works out whether it
+// is the final one.
+func (r *StreamReader) readChunk(c *chunk) error {
+	c.in = c.in[:r.chunkSize+TagSize]
+	n, err := io.ReadFull(r.src, c.in)
+	c.in = c.in[:n]
+
+	switch {
+	case err == io.EOF:
+		return errorf(ErrTruncated, "decryption failed: file is truncated")
+	case err == io.ErrUnexpectedEOF:
+		c.final = true
+	case err != nil:
+		return fmt.Errorf("failed to read chunk: %w", err)
+	default:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			c.final = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+	}
+
+	if n < TagSize {
+		return errorf(ErrTruncated, "decryption failed: file is truncated")
+	}
+	return nil
+}
+
+// open decrypts queued chunks until the work queue is closed.
+func (r *StreamReader) open(aead cipher.AEAD) {
+	for c := range r.work {
+		c.out, c.err = openChunk(aead, r.prefix, r.ad, c)
+		close(c.done)
+	}
+}
+
+// openChunk authenticates and decrypts a single chunk.
+func openChunk(aead cipher.AEAD, prefix, ad []byte, c *chunk) ([]byte, error) {
+	plain, err := aead.Open(c.out[:0], chunkNonce(prefix, c.counter, c.final), c.in, ad)
+	if err == nil {
+		return plain, nil
+	}
+
+	// A chunk that only opens without the final flag means the chunks
+	// that followed it were cut off.
+	if c.final {
+		if plain, err := aead.Open(c.out[:0], chunkNonce(prefix, c.counter, false), c.in, ad); err == nil {
+			wipeBytes(plain)
+			return c.out[:0], errorf(ErrTruncated, "decryption failed: file is truncated")
+		}
+	}
+	return c.out[:0], errorf(ErrCorrupted, "decryption failed: file is corrupted")
+}
+
+// wipeBytes overwrites b with zeros.
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
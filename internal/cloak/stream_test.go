@@ -0,0 +1,222 @@
+package cloak
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encryptStream(t *testing.T, plaintext, key, prefix []byte, chunkSize, jobs int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, prefix, nil, chunkSize, jobs)
+	if err != nil {
+		t.Fatalf("Failed to create stream writer: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decryptStream(key, prefix, ciphertext []byte, chunkSize, jobs int) ([]byte, error) {
+	r, err := NewStreamReader(bytes.NewReader(ciphertext), key, prefix, nil, chunkSize, jobs)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	const chunkSize = 64
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 7} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := encryptStream(t, plaintext, key, prefix, chunkSize, 1)
+
+		chunks := size/chunkSize + 1
+		if size > 0 && size%chunkSize == 0 {
+			chunks--
+		}
+		if want := size + chunks*TagSize; len(ciphertext) != want {
+			t.Errorf("size %d: expected %d ciphertext bytes, got %d", size, want, len(ciphertext))
+		}
+
+		decrypted, err := decryptStream(key, prefix, ciphertext, chunkSize, 1)
+		if err != nil {
+			t.Fatalf("size %d: decryption failed: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Errorf("size %d: decrypted data doesn't match original", size)
+		}
+	}
+}
+
+func TestStreamDetectsTruncation(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	const chunkSize = 64
+	plaintext := make([]byte, 3*chunkSize+10)
+	rand.Read(plaintext)
+	ciphertext := encryptStream(t, plaintext, key, prefix, chunkSize, 1)
+
+	// Cut exactly at a chunk boundary so every remaining chunk is intact.
+	truncated := ciphertext[:2*(chunkSize+TagSize)]
+	_, err := decryptStream(key, prefix, truncated, chunkSize, 1)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("Expected truncation error, got %v", err)
+	}
+
+	_, err = decryptStream(key, prefix, nil, chunkSize, 1)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("Expected truncation error for empty payload, got %v", err)
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	const chunkSize = 64
+	plaintext := make([]byte, 3*chunkSize)
+	rand.Read(plaintext)
+	ciphertext := encryptStream(t, plaintext, key, prefix, chunkSize, 1)
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[chunkSize+TagSize+5] ^= 0x01
+	if _, err := decryptStream(key, prefix, tampered, chunkSize, 4); err == nil {
+		t.Error("Decryption should fail for a modified chunk")
+	}
+
+	// Swap the first two chunks.
+	n := chunkSize + TagSize
+	swapped := append(append(bytes.Clone(ciphertext[n:2*n]), ciphertext[:n]...), ciphertext[2*n:]...)
+	if _, err := decryptStream(key, prefix, swapped, chunkSize, 4); err == nil {
+		t.Error("Decryption should fail for reordered chunks")
+	}
+
+	wrongKey := make([]byte, KeySize)
+	rand.Read(wrongKey)
+	if _, err := decryptStream(wrongKey, prefix, ciphertext, chunkSize, 4); err == nil {
+		t.Error("Decryption should fail with the wrong key")
+	}
+}
+
+func TestStreamParallelMatchesSequential(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	const chunkSize = 64
+	plaintext := make([]byte, 100*chunkSize+13)
+	rand.Read(plaintext)
+
+	sequential := encryptStream(t, plaintext, key, prefix, chunkSize, 1)
+	for _, jobs := range []int{2, 4, 16} {
+		parallel := encryptStream(t, plaintext, key, prefix, chunkSize, jobs)
+		if !bytes.Equal(sequential, parallel) {
+			t.Fatalf("jobs %d: ciphertext differs from sequential output", jobs)
+		}
+
+		decrypted, err := decryptStream(key, prefix, parallel, chunkSize, jobs)
+		if err != nil {
+			t.Fatalf("jobs %d: decryption failed: %v", jobs, err)
+		}
+		if !bytes.Equal(plaintext, decrypted) {
+			t.Fatalf("jobs %d: decrypted data doesn't match original", jobs)
+		}
+	}
+}
+
+func TestStreamReaderCloseBeforeEOF(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	const chunkSize = 64
+	plaintext := make([]byte, 50*chunkSize)
+	ciphertext := encryptStream(t, plaintext, key, prefix, chunkSize, 4)
+
+	r, err := NewStreamReader(bytes.NewReader(ciphertext), key, prefix, nil, chunkSize, 4)
+	if err != nil {
+		t.Fatalf("Failed to create stream reader: %v", err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func TestStreamWriterReportsWriteErrors(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	w, err := NewStreamWriter(failingWriter{}, key, prefix, nil, 64, 4)
+	if err != nil {
+		t.Fatalf("Failed to create stream writer: %v", err)
+	}
+	w.Write(make([]byte, 1000))
+	if err := w.Close(); err == nil {
+		t.Error("Close should report the write error")
+	}
+}
+
+func TestStreamAuthenticatesAssociatedData(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, prefix, []byte("header"), 64, 2)
+	if err != nil {
+		t.Fatalf("Failed to create stream writer: %v", err)
+	}
+	w.Write(bytes.Repeat([]byte("x"), 200))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, ad := range [][]byte{nil, []byte("Header"), []byte("header")} {
+		r, err := NewStreamReader(bytes.NewReader(buf.Bytes()), key, prefix, ad, 64, 2)
+		if err != nil {
+			t.Fatalf("Failed to create stream reader: %v", err)
+		}
+		_, err = io.ReadAll(r)
+		r.Close()
+		if ok := string(ad) == "header"; ok != (err == nil) {
+			t.Errorf("ad %q: unexpected result %v", ad, err)
+		}
+	}
+}
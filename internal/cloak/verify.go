@@ -0,0 +1,46 @@
+package cloak
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// VerifyResult summarizes an archive checked by Verify.
+type VerifyResult struct {
+	// Entries is the number of entries in the archive.
+	Entries int
+
+	// Size is the total size of the regular files in bytes.
+	Size int64
+}
+
+// Verify decrypts the .cloak file at path and reads every entry of its
+// archive without writing anything to disk. It returns an error matching
+// ErrWrongPassword, ErrCorrupted or ErrTruncated if the file cannot be
+// opened or fails authentication.
+func Verify(path string, opts DecryptOptions) (VerifyResult, error) {
+	archive, err := openPayload(path, opts)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	defer archive.Close()
+
+	var result VerifyResult
+	err = walkArchive(archive, archive.compression, func(header *tar.Header, body io.Reader) error {
+		archive.progress.setFile(header.Name)
+		n, err := io.Copy(io.Discard, archive.progress.watch(body))
+		if err != nil {
+			return archiveError(fmt.Sprintf("failed to read %s", header.Name), err)
+		}
+		result.Entries++
+		result.Size += n
+		return nil
+	})
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	archive.progress.setFile("")
+
+	return result, nil
+}
@@ -0,0 +1,65 @@
+package cloak
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(testDir, 0755)
+
+	// Random data does not compress, so the payload spans two chunks.
+	data := make([]byte, DefaultChunkSize+DefaultChunkSize/2)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(testDir, "random.bin"), data, 0644)
+
+	password := writePasswordFile(t, "password")
+	if _, err := Encrypt(testDir, EncryptOptions{Password: password, KDF: fastKDF}); err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	encrypted := testDir + ".cloak"
+	os.RemoveAll(testDir)
+
+	result, err := Verify(encrypted, DecryptOptions{Password: password})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if result.Entries != 2 || result.Size != int64(len(data)) {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if _, err := os.Stat(testDir); !os.IsNotExist(err) {
+		t.Error("Verify should not write anything to disk")
+	}
+
+	_, err = Verify(encrypted, DecryptOptions{Password: writePasswordFile(t, "wrong")})
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+
+	original, _ := os.ReadFile(encrypted)
+	headerSize := len(original) - len(payload(t, encrypted))
+
+	corrupted := filepath.Join(tempDir, "corrupted.cloak")
+	tampered := append([]byte(nil), original...)
+	tampered[headerSize+100] ^= 1
+	os.WriteFile(corrupted, tampered, 0644)
+	if _, err := Verify(corrupted, DecryptOptions{Password: password}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+
+	truncated := filepath.Join(tempDir, "truncated.cloak")
+	os.WriteFile(truncated, original[:headerSize+DefaultChunkSize+TagSize], 0644)
+	if _, err := Verify(truncated, DecryptOptions{Password: password}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+
+	os.WriteFile(truncated, original[:headerSize/2], 0644)
+	if _, err := Verify(truncated, DecryptOptions{Password: password}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated for a cut header, got %v", err)
+	}
+}
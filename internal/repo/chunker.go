@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Default chunk sizes. Chunks are cut where the rolling hash of the content
+// matches a mask, so an insertion only changes the chunks around it.
+const (
+	// MinChunkSize is the size below which no chunk is cut.
+	MinChunkSize = 512 << 10
+
+	// AvgChunkSize is the expected size of a chunk. It must be a power
+	// of two.
+	AvgChunkSize = 1 << 20
+
+	// MaxChunkSize is the size at which a chunk is cut regardless of its
+	// content.
+	MaxChunkSize = 8 << 20
+)
+
+// gearTable maps every byte value to a random 64-bit number for the rolling
+// hash.
+type gearTable [256]uint64
+
+// newGearTable derives the hash table from key, so that chunk boundaries,
+// and thereby chunk sizes, reveal nothing about the content to someone
+// without the key.
+func newGearTable(key []byte) *gearTable {
+	var table gearTable
+	mac := hmac.New(sha256.New, key)
+	for i := range table {
+		mac.Reset()
+		mac.Write([]byte("cloak gear"))
+		mac.Write([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+	return &table
+}
+
+// chunker splits a stream into content-defined chunks with a gear hash.
+type chunker struct {
+	r     io.Reader
+	table *gearTable
+
+	min, max int
+	mask     uint64
+
+	buf []byte
+	n   int
+	eof bool
+}
+
+// newChunker returns a chunker for r with the given sizes.
+func newChunker(r io.Reader, table *gearTable, min, avg, max int) *chunker {
+	return &chunker{
+		r:     r,
+		table: table,
+		min:   min,
+		max:   max,
+		mask:  uint64(avg - 1),
+		buf:   make([]byte, max),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.boundary(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// boundary returns the length of the chunk at the start of data.
+func (c *chunker) boundary(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	end := min(len(data), c.max)
+
+	var h uint64
+	for i := c.min; i < end; i++ {
+		h = h<<1 + c.table[data[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Small chunk sizes keep the tests fast.
+const (
+	testMin = 1 << 10
+	testAvg = 4 << 10
+	testMax = 16 << 10
+)
+
+// split returns the chunks of data.
+func split(t *testing.T, data []byte, table *gearTable) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data), table, testMin, testAvg, testMax)
+	var chunks [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("next failed: %v", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := split(t, data, newGearTable([]byte("key")))
+	if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+		t.Fatal("Chunks do not add up to the input")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > testMax || (len(chunk) < testMin && i != len(chunks)-1) {
+			t.Errorf("Chunk %d has size %d", i, len(chunk))
+		}
+	}
+	if avg := len(data) / len(chunks); avg < testMin || avg > 2*testAvg+testMin {
+		t.Errorf("Average chunk size %d is far from %d", avg, testAvg)
+	}
+
+	if chunks := split(t, nil, newGearTable([]byte("key"))); len(chunks) != 0 {
+		t.Errorf("Empty input gave %d chunks", len(chunks))
+	}
+}
+
+func TestChunkerIsContentDefined(t *testing.T) {
+	data := make([]byte, 512<<10)
+	rand.New(rand.NewSource(2)).Read(data)
+	table := newGearTable([]byte("key"))
+
+	// Inserting bytes near the start only changes the chunks around the
+	// insertion; the rest are found again.
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+
+	before := make(map[string]bool)
+	for _, chunk := range split(t, data, table) {
+		before[string(chunk)] = true
+	}
+	after := split(t, edited, table)
+	shared := 0
+	for _, chunk := range after {
+		if before[string(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(after)-3 {
+		t.Errorf("Only %d of %d chunks are shared after an insertion", shared, len(after))
+	}
+
+	other := split(t, data, newGearTable([]byte("other key")))
+	if len(other) == len(after) && bytes.Equal(other[0], after[0]) {
+		t.Error("Chunk boundaries should depend on the key")
+	}
+}
@@ -0,0 +1,49 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLocked is returned when another backup or prune holds the lock of a
+// repository.
+var ErrLocked = errors.New("repository is locked")
+
+// lock creates the lock file of the repository, so that a prune never runs
+// while a backup stores chunks it has not yet recorded in a snapshot. The
+// file names the operation and the process that holds it. The returned
+// function removes it.
+//
+// A lock left behind by a process that crashed must be removed by hand; the
+// error names the file.
+func (r *Repository) lock(operation string) (func(), error) {
+	path := filepath.Join(r.path, lockName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		by := ""
+		if holder, _ := os.ReadFile(path); len(bytes.TrimSpace(holder)) > 0 {
+			by = " by " + string(bytes.TrimSpace(holder))
+		}
+		return nil, fmt.Errorf("%w%s; if no other cloak process uses it, remove %s", ErrLocked, by, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	_, err = fmt.Fprintf(file, "%s on %s (pid %d) since %s\n",
+		operation, hostname, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+
+	return func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PruneOptions configures Prune.
+type PruneOptions struct {
+	// Forget lists the ids, or unique id prefixes, of snapshots to remove.
+	Forget []string
+
+	// KeepLast, if positive, removes all but the newest KeepLast
+	// snapshots.
+	KeepLast int
+}
+
+// PruneResult summarizes what Prune removed.
+type PruneResult struct {
+	// Snapshots is the number of snapshots removed.
+	Snapshots int
+
+	// Chunks is the number of chunks removed.
+	Chunks int
+
+	// Freed is the number of bytes freed by the removed chunks.
+	Freed int64
+}
+
+// Prune removes snapshots, then every chunk that no remaining snapshot
+// refers to. Without options it only removes unreferenced chunks, such as
+// those left behind by an interrupted backup. It returns ErrLocked if
+// another backup or prune is running.
+func (r *Repository) Prune(opts PruneOptions) (*PruneResult, error) {
+	unlock, err := r.lock("prune")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	forget := make(map[string]bool)
+	for _, prefix := range opts.Forget {
+		s, err := findSnapshot(snapshots, prefix)
+		if err != nil {
+			return nil, err
+		}
+		forget[s.ID] = true
+	}
+	if opts.KeepLast > 0 && len(snapshots) > opts.KeepLast {
+		for _, s := range snapshots[:len(snapshots)-opts.KeepLast] {
+			forget[s.ID] = true
+		}
+	}
+
+	// Snapshots are removed before their chunks, so an interrupted prune
+	// never leaves a snapshot with missing chunks.
+	result := &PruneResult{}
+	used := make(map[string]bool)
+	for _, s := range snapshots {
+		if forget[s.ID] {
+			if err := os.Remove(r.snapshotPath(s.ID)); err != nil {
+				return nil, fmt.Errorf("failed to remove snapshot: %w", err)
+			}
+			result.Snapshots++
+			continue
+		}
+		for _, n := range s.nodes {
+			for _, id := range n.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	dirs, err := os.ReadDir(filepath.Join(r.path, dataDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(r.path, dataDir, dir.Name())
+		entries, err := os.ReadDir(dirPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list chunks: %w", err)
+		}
+		for _, entry := range entries {
+			id := entry.Name()
+			if !validID(id, sha256.Size) || used[id] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Remove(filepath.Join(dirPath, id)); err != nil {
+				return nil, fmt.Errorf("failed to remove chunk: %w", err)
+			}
+			result.Chunks++
+			result.Freed += info.Size()
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,325 @@
+// Package repo implements a deduplicating encrypted backup repository.
+//
+// Files are split into content-defined chunks. Every unique chunk is
+// encrypted once and stored under a keyed hash of its contents, so data
+// shared by several files or snapshots takes space only once. A snapshot is
+// an encrypted list of the paths it contains and the chunks of each file.
+//
+// A repository is a directory with this layout:
+//
+//	key                 the master key, wrapped with a password-derived key
+//	data/ab/abcd...     encrypted chunks, named by their id
+//	snapshots/0123...   encrypted snapshot manifests
+//	lock                present while a backup or prune runs
+//
+// The master key is derived and wrapped with the Argon2id and AES-256-GCM
+// primitives of the cloak package. Backups and prunes lock the repository,
+// so only one of them runs at a time.
+package repo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+)
+
+// keyVersion is the version of the key file format.
+const keyVersion = 1
+
+// masterKeySize is the size of the master key: an AES-256 key for the
+// chunks and snapshots, followed by an HMAC-SHA256 key for the chunk ids.
+const masterKeySize = 2 * cloak.KeySize
+
+// Names of the files and directories of a repository.
+const (
+	keyName      = "key"
+	dataDir      = "data"
+	snapshotsDir = "snapshots"
+	lockName     = "lock"
+)
+
+// passwordPrompt is shown when the password is read from the terminal.
+const passwordPrompt = "Enter repository password: "
+
+// keyFile is the JSON content of the key file.
+type keyFile struct {
+	Version int             `json:"version"`
+	KDF     cloak.KDFParams `json:"argon2id"`
+	Salt    []byte          `json:"salt"`
+	Nonce   []byte          `json:"nonce"`
+	Key     []byte          `json:"key"`
+
+	// Check is the key check value of the wrapping key, which tells a
+	// wrong password apart from a damaged key file.
+	Check []byte `json:"check,omitempty"`
+}
+
+// InitOptions configures Init.
+type InitOptions struct {
+	// Password supplies the repository password. Nil reads it from the
+	// terminal.
+	Password cloak.PasswordProvider
+
+	// KDF holds the Argon2id parameters that derive the key wrapping the
+	// master key. The zero value uses cloak.DefaultKDFParams.
+	KDF cloak.KDFParams
+}
+
+// Init creates an empty repository at path, which must not exist or be an
+// empty directory.
+func Init(path string, opts InitOptions) error {
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s already exists and is not empty", path)
+	}
+
+	kdf := opts.KDF
+	if kdf == (cloak.KDFParams{}) {
+		kdf = cloak.DefaultKDFParams
+	}
+	if err := kdf.Validate(); err != nil {
+		return err
+	}
+
+	masterKey, err := cloak.GenerateRandomBytes(masterKeySize)
+	if err != nil {
+		return err
+	}
+	master := &cloak.SecureBytes{Data: masterKey}
+	defer master.Wipe()
+
+	password, err := passwordProvider(opts.Password).Password(passwordPrompt, true)
+	if err != nil {
+		return err
+	}
+	defer password.Wipe()
+
+	salt, err := cloak.GenerateRandomBytes(cloak.SaltSize)
+	if err != nil {
+		return err
+	}
+	nonce, err := cloak.GenerateRandomBytes(cloak.NonceSize)
+	if err != nil {
+		return err
+	}
+	wrapKey := cloak.DeriveKeyWithParams(password.Data, salt, kdf)
+	defer wrapKey.Wipe()
+
+	wrapped, err := cloak.EncryptData(master.Data, wrapKey.Data, nonce)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(keyFile{
+		Version: keyVersion,
+		KDF:     kdf,
+		Salt:    salt,
+		Nonce:   nonce,
+		Key:     wrapped,
+		Check:   cloak.KeyCheck(wrapKey.Data),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{dataDir, snapshotsDir} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return fmt.Errorf("failed to create repository: %w", err)
+		}
+	}
+	return writeFileAtomic(filepath.Join(path, keyName), data)
+}
+
+// Repository is an open repository. Call Close to wipe its keys.
+type Repository struct {
+	path    string
+	dataKey *cloak.SecureBytes
+	idKey   *cloak.SecureBytes
+	gear    *gearTable
+}
+
+// Open unlocks the repository at path with the password from password. Nil
+// reads it from the terminal. A wrong password returns an error matching
+// cloak.ErrWrongPassword.
+func Open(path string, password cloak.PasswordProvider) (*Repository, error) {
+	data, err := os.ReadFile(filepath.Join(path, keyName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not a cloak repository", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository key: %w", err)
+	}
+
+	var key keyFile
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("invalid repository key: %w", cloak.ErrCorrupted)
+	}
+	if key.Version != keyVersion {
+		return nil, fmt.Errorf("repository version %d: %w", key.Version, cloak.ErrUnsupportedVersion)
+	}
+	if err := key.KDF.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid repository key: %v: %w", err, cloak.ErrCorrupted)
+	}
+	if len(key.Salt) != cloak.SaltSize || len(key.Nonce) != cloak.NonceSize || (key.Check != nil && len(key.Check) != cloak.KeyCheckSize) {
+		return nil, fmt.Errorf("invalid repository key: %w", cloak.ErrCorrupted)
+	}
+
+	secret, err := passwordProvider(password).Password(passwordPrompt, false)
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Wipe()
+
+	wrapKey := cloak.DeriveKeyWithParams(secret.Data, key.Salt, key.KDF)
+	defer wrapKey.Wipe()
+
+	if key.Check != nil && !hmac.Equal(cloak.KeyCheck(wrapKey.Data), key.Check) {
+		return nil, fmt.Errorf("failed to open repository: %w", cloak.ErrWrongPassword)
+	}
+	master, err := cloak.DecryptData(key.Key, wrapKey.Data, key.Nonce)
+	if err != nil && key.Check != nil {
+		return nil, fmt.Errorf("invalid repository key: %w", cloak.ErrCorrupted)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", cloak.ErrWrongPassword)
+	}
+	if len(master) != masterKeySize {
+		(&cloak.SecureBytes{Data: master}).Wipe()
+		return nil, fmt.Errorf("invalid repository key: %w", cloak.ErrCorrupted)
+	}
+
+	r := &Repository{
+		path:    path,
+		dataKey: &cloak.SecureBytes{Data: master[:cloak.KeySize]},
+		idKey:   &cloak.SecureBytes{Data: master[cloak.KeySize:]},
+	}
+	r.gear = newGearTable(r.idKey.Data)
+	return r, nil
+}
+
+// Close wipes the keys of the repository.
+func (r *Repository) Close() {
+	r.dataKey.Wipe()
+	r.idKey.Wipe()
+}
+
+// chunkID returns the id of a chunk: the hex-encoded HMAC-SHA256 of its
+// contents under the id key.
+func (r *Repository) chunkID(chunk []byte) string {
+	mac := hmac.New(sha256.New, r.idKey.Data)
+	mac.Write(chunk)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkPath returns the path of the chunk file with the given id.
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, dataDir, id[:2], id)
+}
+
+// hasChunk reports whether the chunk with the given id is stored.
+func (r *Repository) hasChunk(id string) bool {
+	_, err := os.Stat(r.chunkPath(id))
+	return err == nil
+}
+
+// storeChunk encrypts chunk and stores it under id. It returns the number
+// of bytes written.
+func (r *Repository) storeChunk(id string, chunk []byte) (int64, error) {
+	data, err := r.seal(chunk)
+	if err != nil {
+		return 0, err
+	}
+	path := r.chunkPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, fmt.Errorf("failed to store chunk: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return 0, fmt.Errorf("failed to store chunk: %w", err)
+	}
+	return int64(len(data)), nil
+}
+
+// loadChunk reads and decrypts the chunk with the given id, and checks that
+// its contents match the id.
+func (r *Repository) loadChunk(id string) ([]byte, error) {
+	if !validID(id, sha256.Size) {
+		return nil, fmt.Errorf("invalid chunk id %q: %w", id, cloak.ErrCorrupted)
+	}
+	data, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", id, err)
+	}
+	chunk, err := r.open(data)
+	if err != nil || !hmac.Equal([]byte(r.chunkID(chunk)), []byte(id)) {
+		return nil, fmt.Errorf("chunk %s: %w", id, cloak.ErrCorrupted)
+	}
+	return chunk, nil
+}
+
+// seal encrypts plaintext with the data key under a random nonce, which is
+// prepended to the result.
+func (r *Repository) seal(plaintext []byte) ([]byte, error) {
+	nonce, err := cloak.GenerateRandomBytes(cloak.NonceSize)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := cloak.EncryptData(plaintext, r.dataKey.Data, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+// open decrypts data written by seal.
+func (r *Repository) open(data []byte) ([]byte, error) {
+	if len(data) < cloak.NonceSize {
+		return nil, cloak.ErrTruncated
+	}
+	return cloak.DecryptData(data[cloak.NonceSize:], r.dataKey.Data, data[:cloak.NonceSize])
+}
+
+// validID reports whether id is the hex encoding of size bytes.
+func validID(id string, size int) bool {
+	if len(id) != 2*size {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// passwordProvider returns p, or a cloak.TerminalPassword if p is nil.
+func passwordProvider(p cloak.PasswordProvider) cloak.PasswordProvider {
+	if p == nil {
+		return cloak.TerminalPassword{}
+	}
+	return p
+}
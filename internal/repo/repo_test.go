@@ -0,0 +1,202 @@
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+)
+
+// fastKDF keeps key derivation quick in tests.
+var fastKDF = cloak.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+// openTestRepo creates a repository and opens it. Its password is stored
+// in a file named password next to the repository.
+func openTestRepo(t *testing.T) (*Repository, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "repo")
+	password := cloak.FilePassword{Path: filepath.Join(dir, "password")}
+	if err := os.WriteFile(password.Path, []byte("password\n"), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+	if err := Init(path, InitOptions{Password: password, KDF: fastKDF}); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	r, err := Open(path, password)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(r.Close)
+	return r, path
+}
+
+func TestOpenWithWrongPassword(t *testing.T) {
+	_, path := openTestRepo(t)
+	password := cloak.FilePassword{Path: filepath.Join(filepath.Dir(path), "password")}
+	wrong := cloak.FilePassword{Path: filepath.Join(t.TempDir(), "wrong")}
+	os.WriteFile(wrong.Path, []byte("wrong\n"), 0600)
+
+	if _, err := Open(path, wrong); !errors.Is(err, cloak.ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+	if err := Init(path, InitOptions{Password: password, KDF: fastKDF}); err == nil {
+		t.Error("Init should refuse an existing repository")
+	}
+
+	// The key check value matches the right password, so a wrapped key
+	// that fails to open means the key file was damaged.
+	data, err := os.ReadFile(filepath.Join(path, keyName))
+	if err != nil {
+		t.Fatalf("Failed to read key: %v", err)
+	}
+	var key keyFile
+	if err := json.Unmarshal(data, &key); err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	key.Key[0] ^= 1
+	data, _ = json.Marshal(key)
+	os.WriteFile(filepath.Join(path, keyName), data, 0600)
+	if _, err := Open(path, password); !errors.Is(err, cloak.ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	if _, err := Open(path, wrong); !errors.Is(err, cloak.ErrWrongPassword) {
+		t.Errorf("Expected ErrWrongPassword, got %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	r, _ := openTestRepo(t)
+
+	tempDir := t.TempDir()
+	testDir := filepath.Join(tempDir, "data")
+	os.MkdirAll(filepath.Join(testDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(testDir, "a.txt"), []byte("same content"), 0644)
+	os.WriteFile(filepath.Join(testDir, "sub", "b.txt"), []byte("same content"), 0600)
+	os.WriteFile(filepath.Join(testDir, "empty"), nil, 0644)
+	os.Symlink("a.txt", filepath.Join(testDir, "link"))
+
+	first, err := r.Backup([]string{testDir})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if first.Chunks != 2 || first.NewChunks != 1 {
+		t.Errorf("Identical files should share a chunk: %+v", first)
+	}
+	if s := first.Snapshot; s.Files != 3 || s.Size != 24 {
+		t.Errorf("Unexpected snapshot summary: %+v", s)
+	}
+
+	os.WriteFile(filepath.Join(testDir, "c.txt"), []byte("new"), 0644)
+	second, err := r.Backup([]string{testDir})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if second.NewChunks != 1 {
+		t.Errorf("Only the new file should be stored: %+v", second)
+	}
+
+	snapshots, err := r.Snapshots()
+	if err != nil || len(snapshots) != 2 {
+		t.Fatalf("Snapshots returned %d snapshots, %v", len(snapshots), err)
+	}
+	if s, err := r.FindSnapshot(first.Snapshot.ShortID()); err != nil || s.ID != first.Snapshot.ID {
+		t.Errorf("FindSnapshot by prefix returned %v, %v", s, err)
+	}
+
+	restoreDir := filepath.Join(tempDir, "restored")
+	s, err := r.FindSnapshot("latest")
+	if err != nil {
+		t.Fatalf("FindSnapshot failed: %v", err)
+	}
+	if err := r.Restore(s, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for name, content := range map[string]string{"a.txt": "same content", "sub/b.txt": "same content", "c.txt": "new", "empty": ""} {
+		data, err := os.ReadFile(filepath.Join(restoreDir, "data", name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(restoreDir, "data", "sub", "b.txt")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Mode was not restored: %v, %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(restoreDir, "data", "link")); err != nil || link != "a.txt" {
+		t.Errorf("Symlink was not restored: %q, %v", link, err)
+	}
+
+	if err := r.Restore(s, restoreDir); err == nil {
+		t.Error("Restore should not replace existing files")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	r, path := openTestRepo(t)
+
+	testDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "kept.txt"), []byte("kept"), 0644)
+	os.WriteFile(filepath.Join(testDir, "old.txt"), []byte("old"), 0644)
+	if _, err := r.Backup([]string{testDir}); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	os.Remove(filepath.Join(testDir, "old.txt"))
+	latest, err := r.Backup([]string{testDir})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	result, err := r.Prune(PruneOptions{KeepLast: 1})
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if result.Snapshots != 1 || result.Chunks != 1 {
+		t.Errorf("Expected one snapshot and one chunk removed: %+v", result)
+	}
+
+	if err := r.Restore(latest.Snapshot, filepath.Join(t.TempDir(), "out")); err != nil {
+		t.Errorf("Restore after prune failed: %v", err)
+	}
+
+	// A modified chunk is detected on restore.
+	id := latest.Snapshot.nodes[1].Chunks[0]
+	os.WriteFile(filepath.Join(path, dataDir, id[:2], id), []byte("garbage that is long enough"), 0600)
+	if err := r.Restore(latest.Snapshot, filepath.Join(t.TempDir(), "out")); !errors.Is(err, cloak.ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	r, path := openTestRepo(t)
+
+	testDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "file.txt"), []byte("content"), 0644)
+
+	unlock, err := r.lock("backup")
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if _, err := r.Prune(PruneOptions{}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Prune during a backup: expected ErrLocked, got %v", err)
+	}
+	if _, err := r.Backup([]string{testDir}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Backup during a backup: expected ErrLocked, got %v", err)
+	}
+	unlock()
+
+	if _, err := r.Backup([]string{testDir}); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if _, err := r.Prune(PruneOptions{}); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, lockName)); !os.IsNotExist(err) {
+		t.Errorf("The lock should be removed, got %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package repo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vsamidurai/cloak/internal/cloak"
+)
+
+// snapshotIDSize is the number of random bytes in a snapshot id.
+const snapshotIDSize = 16
+
+// Types of the nodes of a snapshot.
+const (
+	nodeDir     = "dir"
+	nodeFile    = "file"
+	nodeSymlink = "symlink"
+)
+
+// Snapshot describes a backup stored in a repository.
+type Snapshot struct {
+	// ID is the hex-encoded id of the snapshot.
+	ID string `json:"id"`
+
+	// Time is when the backup was started.
+	Time time.Time `json:"time"`
+
+	// Hostname is the name of the machine the backup was made on.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Paths are the absolute paths that were backed up.
+	Paths []string `json:"paths"`
+
+	// Files is the number of regular files in the snapshot.
+	Files int `json:"files"`
+
+	// Size is the total size of the regular files in bytes.
+	Size int64 `json:"size"`
+
+	// nodes are the paths of the snapshot in the order they were found.
+	nodes []node
+}
+
+// ShortID returns the first eight characters of the id.
+func (s *Snapshot) ShortID() string {
+	return s.ID[:8]
+}
+
+// node is a directory, file or symlink of a snapshot.
+type node struct {
+	// Name is the slash-separated path below the parent of the backed
+	// up path.
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"mtime"`
+	Size     int64       `json:"size,omitempty"`
+	Linkname string      `json:"linkname,omitempty"`
+	Chunks   []string    `json:"chunks,omitempty"`
+}
+
+// snapshotFile is the JSON content of a snapshot file.
+type snapshotFile struct {
+	*Snapshot
+	Nodes []node `json:"nodes"`
+}
+
+// BackupResult summarizes a backup.
+type BackupResult struct {
+	// Snapshot is the new snapshot.
+	Snapshot *Snapshot
+
+	// Chunks is the number of chunks the files were split into.
+	Chunks int
+
+	// NewChunks is the number of chunks that were not stored yet.
+	NewChunks int
+
+	// Added is the number of bytes added to the repository.
+	Added int64
+}
+
+// Backup stores the folders and files at paths as a new snapshot. Each path
+// is stored under its base name, so the names must differ. Chunks that are
+// already in the repository are not stored again. It returns ErrLocked if
+// another backup or prune is running.
+func (r *Repository) Backup(paths []string) (*BackupResult, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths to back up")
+	}
+
+	unlock, err := r.lock("backup")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	id, err := cloak.GenerateRandomBytes(snapshotIDSize)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{ID: hex.EncodeToString(id), Time: time.Now().UTC()}
+	snapshot.Hostname, _ = os.Hostname()
+
+	names := make(map[string]string, len(paths))
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(absPath); err != nil {
+			return nil, fmt.Errorf("cannot access path: %w", err)
+		}
+		name := filepath.Base(absPath)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be stored as %q", other, path, name)
+		}
+		names[name] = path
+		snapshot.Paths = append(snapshot.Paths, absPath)
+	}
+
+	result := &BackupResult{Snapshot: snapshot}
+	for _, root := range snapshot.Paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(root), path)
+			if err != nil {
+				return err
+			}
+			n := node{
+				Name:    filepath.ToSlash(rel),
+				Mode:    info.Mode(),
+				ModTime: info.ModTime().UTC(),
+			}
+
+			switch {
+			case info.IsDir():
+				n.Type = nodeDir
+			case info.Mode().IsRegular():
+				n.Type = nodeFile
+				if err := r.backupFile(path, &n, result); err != nil {
+					return err
+				}
+				snapshot.Files++
+				snapshot.Size += n.Size
+			case info.Mode()&os.ModeSymlink != 0:
+				n.Type = nodeSymlink
+				if n.Linkname, err = os.Readlink(path); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+
+			snapshot.nodes = append(snapshot.nodes, n)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %w", root, err)
+		}
+	}
+
+	if err := r.saveSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// backupFile splits the file at path into chunks, stores the new ones and
+// records them in n.
+func (r *Repository) backupFile(path string, n *node, result *BackupResult) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	chunks := newChunker(file, r.gear, MinChunkSize, AvgChunkSize, MaxChunkSize)
+	for {
+		chunk, err := chunks.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		id := r.chunkID(chunk)
+		if !r.hasChunk(id) {
+			written, err := r.storeChunk(id, chunk)
+			if err != nil {
+				return err
+			}
+			result.NewChunks++
+			result.Added += written
+		}
+		result.Chunks++
+		n.Size += int64(len(chunk))
+		n.Chunks = append(n.Chunks, id)
+	}
+}
+
+// snapshotPath returns the path of the snapshot file with the given id.
+func (r *Repository) snapshotPath(id string) string {
+	return filepath.Join(r.path, snapshotsDir, id)
+}
+
+// saveSnapshot encrypts and stores a snapshot.
+func (r *Repository) saveSnapshot(s *Snapshot) error {
+	data, err := json.Marshal(snapshotFile{Snapshot: s, Nodes: s.nodes})
+	if err != nil {
+		return err
+	}
+	sealed, err := r.seal(data)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.snapshotPath(s.ID), sealed); err != nil {
+		return fmt.Errorf("failed to store snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot reads and decrypts the snapshot with the given id.
+func (r *Repository) loadSnapshot(id string) (*Snapshot, error) {
+	data, err := os.ReadFile(r.snapshotPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	plaintext, err := r.open(data)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, cloak.ErrCorrupted)
+	}
+
+	file := snapshotFile{Snapshot: &Snapshot{}}
+	if err := json.Unmarshal(plaintext, &file); err != nil || file.ID != id {
+		return nil, fmt.Errorf("snapshot %s: %w", id, cloak.ErrCorrupted)
+	}
+	file.Snapshot.nodes = file.Nodes
+	return file.Snapshot, nil
+}
+
+// Snapshots returns the snapshots of the repository, oldest first.
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(filepath.Join(r.path, snapshotsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		if !validID(entry.Name(), snapshotIDSize) {
+			continue
+		}
+		s, err := r.loadSnapshot(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot whose id starts with prefix, or the
+// newest snapshot if prefix is "latest".
+func (r *Repository) FindSnapshot(prefix string) (*Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	return findSnapshot(snapshots, prefix)
+}
+
+// findSnapshot returns the snapshot of snapshots whose id starts with
+// prefix, or the last one if prefix is "latest".
+func findSnapshot(snapshots []*Snapshot, prefix string) (*Snapshot, error) {
+	if prefix == "latest" {
+		if len(snapshots) == 0 {
+			return nil, errors.New("the repository has no snapshots")
+		}
+		return snapshots[len(snapshots)-1], nil
+	}
+
+	var found *Snapshot
+	for _, s := range snapshots {
+		if prefix != "" && strings.HasPrefix(s.ID, prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("snapshot id %q is ambiguous", prefix)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot %q", prefix)
+	}
+	return found, nil
+}
+
+// Restore extracts a snapshot into destDir, which is created if needed.
+// Existing directories are merged into, but existing files are never
+// replaced: Restore stops with an error instead.
+func (r *Repository) Restore(s *Snapshot, destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	for _, n := range s.nodes {
+		cleanName := filepath.Clean(filepath.FromSlash(n.Name))
+		if strings.HasPrefix(cleanName, "..") || filepath.IsAbs(cleanName) {
+			return fmt.Errorf("invalid path in snapshot: %s", n.Name)
+		}
+		target := filepath.Join(destDir, cleanName)
+
+		var err error
+		switch n.Type {
+		case nodeDir:
+			err = os.MkdirAll(target, n.Mode.Perm())
+		case nodeSymlink:
+			err = os.Symlink(n.Linkname, target)
+		case nodeFile:
+			err = r.restoreFile(n, target)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the chunks of n to a new file at target.
+func (r *Repository) restoreFile(n node, target string) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, n.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range n.Chunks {
+		chunk, err := r.loadChunk(id)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Write(chunk); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, n.ModTime, n.ModTime)
+}